@@ -5,6 +5,7 @@ go 1.23.6
 require (
 	github.com/charmbracelet/bubbletea v1.3.6
 	github.com/mdp/qrterminal/v3 v3.2.1
+	golang.org/x/sys v0.34.0
 )
 
 require (
@@ -25,7 +26,6 @@ require (
 	github.com/rivo/uniseg v0.4.7 // indirect
 	github.com/xo/terminfo v0.0.0-20220910002029-abceb7e1c41e // indirect
 	golang.org/x/sync v0.16.0 // indirect
-	golang.org/x/sys v0.34.0 // indirect
 	golang.org/x/term v0.21.0 // indirect
 	golang.org/x/text v0.27.0 // indirect
 	rsc.io/qr v0.2.0 // indirect
@@ -3,32 +3,103 @@ package main
 import (
 	"flag"
 	"log"
+	"log/slog"
+	"os"
+	"strings"
 
+	"go.sakib.dev/le/logger"
 	"go.sakib.dev/le/server"
 	"go.sakib.dev/le/tui"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "share" {
+		if err := runShare(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	dir := flag.String("dir", ".", "Directory to serve files from")
-	port := flag.Int("port", 8080, "Port to run the file server on")
+	port := flag.Int("port", 8080, "Port to run the file server on, 0 picks any free port")
+	portFallback := flag.Bool("port-fallback", true, "Use the next free port if the port is taken")
+	upload := flag.Bool("upload", false, "Allow clients to upload files into the served directory")
+	hidden := flag.String("hidden", string(server.HiddenHide), "How to treat dot files: hide them from listings (hide), show them (show) or refuse to serve them (deny)")
+	disposition := flag.String("disposition", string(server.DispositionInline), "Whether browsers should show files (inline) or save them (attachment)")
+	password := flag.String("password", "", "Require this password for HTTP Basic auth, defaults to $LE_PASSWORD")
+	token := flag.Bool("token", false, "Require a random access token, the URL in the QR code carries it")
+	allow := flag.String("allow", strings.Join(server.DefaultAllowedNetworks, ","), "Comma separated networks or IPs that may connect, empty allows all")
+	deny := flag.String("deny", "", "Comma separated networks or IPs that may not connect")
+	useTLS := flag.Bool("tls", false, "Serve HTTPS with a self-signed certificate")
+	tlsCert := flag.String("tls-cert", "", "Serve HTTPS with this PEM certificate file instead, requires --tls-key")
+	tlsKey := flag.String("tls-key", "", "PEM key file of --tls-cert")
+	approve := flag.Bool("approve", false, "Ask in the terminal before a new device may connect")
+	trashRetention := flag.Duration("trash-retention", server.DefaultTrashRetention, "How long deleted and overwritten files are kept in the trash")
 
 	flag.Parse()
 
+	dispositionPolicy, err := server.ParseDisposition(*disposition)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	hiddenPolicy, err := server.ParseHiddenPolicy(*hidden)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("--tls-cert and --tls-key must be given together")
+	}
+
+	policy, err := server.NewIPPolicy(splitList(*allow), splitList(*deny))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	slog.SetDefault(slog.New(logger.NewHandler()))
+
 	eventCh := make(chan server.ServerEventName, 10)
 	srvr, err := server.NewServer(*dir, *port, eventCh)
 
 	if err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
+	srvr.Upload = *upload
+	srvr.Disposition = dispositionPolicy
+	srvr.Hidden = hiddenPolicy
+	srvr.TrashRetention = *trashRetention
+	srvr.PortFallback = *portFallback
+	srvr.Password = *password
+	if srvr.Password == "" {
+		srvr.Password = os.Getenv("LE_PASSWORD")
+	}
+	srvr.Policy = policy
+	srvr.TLS = *useTLS || *tlsCert != ""
+	srvr.TLSCert = *tlsCert
+	srvr.TLSKey = *tlsKey
+	srvr.RequireApproval = *approve
+	if *token {
+		srvr.Token = server.NewToken()
+	}
 
-	go func() {
-		if err := srvr.Start(); err != nil {
-			log.Fatalf("Failed to start srvr: %v", err)
-		}
-	}()
+	// bind the port before the UI takes over the terminal, the UI shows the
+	// error and offers to retry on another port
+	listenErr := srvr.Listen()
 
-	err = tui.Start(srvr, eventCh)
+	err = tui.Start(srvr, eventCh, listenErr)
 	if err != nil {
-		log.Fatalf("Failed to start TUI: %v", err)
+		log.Fatal(err)
+	}
+}
+
+// splitList splits a comma separated flag value.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
 }
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package utils
+
+import "errors"
+
+func renameNoReplace(src, dst string) error {
+	return errors.ErrUnsupported
+}
@@ -3,20 +3,25 @@ package utils
 import (
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 type ContextKey string
 
 const (
 	RequestIDKey ContextKey = "reqId"
+	BasePathKey  ContextKey = "basePath" // prefix the handler is mounted on
 )
 
 func GetLocalIP() (string, error) {
@@ -31,6 +36,32 @@ func GetLocalIP() (string, error) {
 	return localAddr.IP.String(), nil
 }
 
+// GetLocalIPs returns the addresses of all interfaces that are up, loopback
+// included.
+func GetLocalIPs() ([]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+	return ips, nil
+}
+
 // GetClientIP does not consider reverse proxies or load balancers
 func GetClientIP(r *http.Request) (string, error) {
 	slog.Debug("Getting client IP", "remoteAddr", r.RemoteAddr)
@@ -58,20 +89,140 @@ func GetClientHostname(r *http.Request) (string, error) {
 	return strings.TrimSuffix(names[0], "."), nil
 }
 
+// DeviceName guesses the kind of device from a User-Agent header, e.g.
+// "iPhone", "Pixel 7" or "curl".
+func DeviceName(userAgent string) string {
+	switch {
+	case userAgent == "":
+		return "Unknown device"
+	case strings.Contains(userAgent, "iPhone"):
+		return "iPhone"
+	case strings.Contains(userAgent, "iPad"):
+		return "iPad"
+	case strings.Contains(userAgent, "Android"):
+		return androidDevice(userAgent)
+	case strings.Contains(userAgent, "CrOS"):
+		return "Chromebook"
+	case strings.Contains(userAgent, "Macintosh"):
+		return "Mac"
+	case strings.Contains(userAgent, "Windows"):
+		return "Windows PC"
+	case strings.Contains(userAgent, "Linux"):
+		return "Linux PC"
+	}
+
+	// command line tools such as "curl/8.5.0"
+	product, _, _ := strings.Cut(userAgent, " ")
+	product, _, _ = strings.Cut(product, "/")
+	return product
+}
+
+// androidDevice returns the model from a User-Agent like "Mozilla/5.0 (Linux;
+// Android 14; Pixel 7 Build/UQ1A) ...". Browsers that hide the model send "K".
+func androidDevice(userAgent string) string {
+	kind := "Android tablet"
+	if strings.Contains(userAgent, "Mobile") {
+		kind = "Android phone"
+	}
+
+	_, rest, _ := strings.Cut(userAgent, "Android")
+	platform, _, _ := strings.Cut(rest, ")")
+	parts := strings.Split(platform, ";")
+	if len(parts) < 2 {
+		return kind
+	}
+
+	model, _, _ := strings.Cut(strings.TrimSpace(parts[len(parts)-1]), " Build/")
+	if model == "" || model == "K" || strings.HasPrefix(model, "wv") {
+		return kind
+	}
+	return model
+}
+
+// ByteRange is an inclusive range of byte offsets.
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+func (r ByteRange) Length() int64 {
+	return r.End - r.Start + 1
+}
+
+var ErrTooManyRanges = errors.New("too many ranges")
+
+var errUnsatisfiableRange = errors.New("range starts past the end")
+
+var rangeSpecRe = regexp.MustCompile(`^(\d*)-(\d*)$`)
+
+// ParseRangeHeader parses a Range header holding a single range.
 func ParseRangeHeader(header string, size int64) (start, end int64, err error) {
 	if header == "" {
 		return 0, 0, nil
 	}
-	re := regexp.MustCompile(`^bytes=(\d*)-(\d*)$`)
 
-	matches := re.FindStringSubmatch(header)
+	ranges, err := ParseRanges(header, size, 1)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range header: %q for size %d", header, size)
+	}
+
+	return ranges[0].Start, ranges[0].End, nil
+}
+
+// ParseRanges parses a Range header with one or more comma separated byte
+// ranges. The result is sorted, overlapping and adjacent ranges are merged.
+// Ranges that start past the end are dropped, the header only fails if none
+// is left. Headers with more than maxRanges ranges fail with ErrTooManyRanges.
+func ParseRanges(header string, size int64, maxRanges int) ([]ByteRange, error) {
+	if header == "" {
+		return nil, nil
+	}
 
 	errMsg := fmt.Errorf("invalid range header: %q for size %d", header, size)
 
+	specs, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, errMsg
+	}
+
+	var ranges []ByteRange
+	n := 0
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		if n == maxRanges {
+			return nil, ErrTooManyRanges
+		}
+		n++
+
+		rng, err := parseRangeSpec(spec, size)
+		if errors.Is(err, errUnsatisfiableRange) {
+			continue
+		} else if err != nil {
+			return nil, errMsg
+		}
+		ranges = append(ranges, rng)
+	}
+
+	if len(ranges) == 0 {
+		return nil, errMsg
+	}
+
+	return coalesceRanges(ranges), nil
+}
+
+// parseRangeSpec parses a single "start-end", "start-" or "-suffix" range.
+// An end past the end of the file is cut to its last byte.
+func parseRangeSpec(spec string, size int64) (ByteRange, error) {
+	matches := rangeSpecRe.FindStringSubmatch(spec)
 	if len(matches) < 3 || (matches[1] == "" && matches[2] == "") {
-		return 0, 0, errMsg
+		return ByteRange{}, errors.New("invalid range")
 	}
 
+	var start, end int64
 	if matches[1] != "" {
 		start, _ = strconv.ParseInt(matches[1], 10, 64)
 	}
@@ -81,19 +232,44 @@ func ParseRangeHeader(header string, size int64) (start, end int64, err error) {
 	}
 
 	if matches[1] == "" {
-		start = size - end
+		// the last end bytes, or the whole file if it is shorter
+		start = max(size-end, 0)
 		end = size - 1
 	}
 
-	if matches[2] == "" {
+	if matches[1] != "" && matches[2] != "" && start > end {
+		return ByteRange{}, errors.New("invalid range")
+	}
+
+	if matches[2] == "" || end >= size {
 		end = size - 1
 	}
 
-	if start > end || end > size {
-		return 0, 0, errMsg
+	// also an empty suffix or any range of an empty file
+	if start > end {
+		return ByteRange{}, errUnsatisfiableRange
+	}
+
+	return ByteRange{Start: start, End: end}, nil
+}
+
+// coalesceRanges sorts ranges and merges the ones that overlap or touch.
+func coalesceRanges(ranges []ByteRange) []ByteRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+
+	merged := ranges[:1]
+	for _, rng := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if rng.Start <= last.End+1 {
+			last.End = max(last.End, rng.End)
+			continue
+		}
+		merged = append(merged, rng)
 	}
 
-	return start, end, nil
+	return merged
 }
 
 var ErrForbiddenPath = errors.New("forbidden path")
@@ -107,16 +283,8 @@ func SecureJoin(base, path string) (string, error) {
 		return "", err
 	}
 
-	parentPath := filepath.Dir(absPath)
-	fileName := filepath.Base(absPath)
-
-	absPath, err = filepath.EvalSymlinks(absPath)
-	if err != nil && os.IsNotExist(err) {
-		evalParent, err := filepath.EvalSymlinks(parentPath)
-		if err == nil {
-			absPath = filepath.Join(evalParent, fileName)
-		}
-	} else if err != nil {
+	absPath, err = evalExistingSymlinks(absPath)
+	if err != nil {
 		return "", err
 	}
 
@@ -130,6 +298,28 @@ func SecureJoin(base, path string) (string, error) {
 	return absPath, nil
 }
 
+// evalExistingSymlinks resolves symlinks in the longest existing prefix of path
+// and appends the components that do not exist yet.
+func evalExistingSymlinks(path string) (string, error) {
+	var missing []string
+	for {
+		evaluated, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(append([]string{evaluated}, missing...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		missing = append([]string{filepath.Base(path)}, missing...)
+		path = parent
+	}
+}
+
 func ValidAbsDir(path string) (string, error) {
 	path, err := filepath.Abs(path)
 
@@ -167,3 +357,147 @@ func ReplaceHome(dir string) string {
 	}
 	return dir
 }
+
+// MoveFile renames src to dst, failing with fs.ErrExist rather than replacing
+// dst. When both are on different file systems the file or directory tree is
+// copied and the source removed afterwards.
+func MoveFile(src, dst string) error {
+	err := RenameNoReplace(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	if err := copyPath(src, dst); err != nil {
+		// dst belongs to someone else if it was there before
+		if !errors.Is(err, fs.ErrExist) {
+			os.RemoveAll(dst)
+		}
+		return err
+	}
+
+	return os.RemoveAll(src)
+}
+
+// RenameNoReplace renames src to dst like os.Rename, but fails with
+// fs.ErrExist rather than replacing dst. Where the system can't do that in one
+// step files are hard linked to dst first, other entries are checked right
+// before they are renamed.
+func RenameNoReplace(src, dst string) error {
+	err := renameNoReplace(src, dst)
+	if !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() {
+		err := os.Link(src, dst)
+		if err == nil {
+			return os.Remove(src)
+		} else if errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		// not every file system has hard links
+	}
+
+	if _, err := os.Lstat(dst); err == nil {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+func copyPath(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+
+	case info.IsDir():
+		if err := os.Mkdir(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := copyPath(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return os.Chtimes(dst, info.ModTime(), info.ModTime())
+
+	default:
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		return os.Chtimes(dst, info.ModTime(), info.ModTime())
+	}
+}
+
+// ContentDisposition builds a Content-Disposition header value as described in
+// RFC 6266. The file name is sent as a plain ASCII fallback and, when needed, as
+// a UTF-8 encoded filename* parameter.
+func ContentDisposition(dispositionType, fileName string) string {
+	fallback := make([]byte, 0, len(fileName))
+	needsEncoding := false
+	for _, r := range fileName {
+		switch {
+		case r == '"' || r == '\\' || r < 0x20 || r >= 0x7f:
+			fallback = append(fallback, '_')
+			needsEncoding = true
+		default:
+			fallback = append(fallback, byte(r))
+		}
+	}
+
+	value := fmt.Sprintf(`%s; filename="%s"`, dispositionType, fallback)
+	if needsEncoding {
+		value += "; filename*=UTF-8''" + encodeRFC5987(fileName)
+	}
+	return value
+}
+
+// encodeRFC5987 percent-encodes everything but the attr-char set of RFC 5987.
+func encodeRFC5987(s string) string {
+	const attrChars = "!#$&+-.^_`|~"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.IndexByte(attrChars, c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
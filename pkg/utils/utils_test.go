@@ -1,13 +1,14 @@
-
 package utils
 
-
 import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
-
-
 func TestGetLocalIP(t *testing.T) {
 	ip, err := GetLocalIP()
 	if err != nil {
@@ -18,6 +19,19 @@ func TestGetLocalIP(t *testing.T) {
 	}
 }
 
+func TestGetLocalIPs(t *testing.T) {
+	ips, err := GetLocalIPs()
+	if err != nil {
+		t.Fatalf("GetLocalIPs returned error: %v", err)
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() {
+			return
+		}
+	}
+	t.Errorf("GetLocalIPs returned no loopback address: %v", ips)
+}
+
 func TestParseRangeHeader(t *testing.T) {
 	tests := []struct {
 		header    string
@@ -28,13 +42,14 @@ func TestParseRangeHeader(t *testing.T) {
 	}{
 		{"bytes=0-99", 100, 0, 99, false},
 		{"bytes=10-20", 50, 10, 20, false},
-		{"bytes=10-", 50, 10, 49, false}, // end not specified, should be last byte
+		{"bytes=10-", 50, 10, 49, false},  // end not specified, should be last byte
 		{"bytes=-20", 100, 80, 99, false}, // last 20 bytes
 		{"bytes=0-0", 1, 0, 0, false},
 		{"bytes=0-", 100, 0, 99, false},
-		{"bytes=0-150", 100, 0, 0, true}, // end out of bounds
-		{"bytes=-10-20", 100, 0, 0, true}, // negative start
-		{"", 100, 0, 0, false}, // empty header
+		{"bytes=0-150", 100, 0, 99, false}, // end out of bounds, cut to the last byte
+		{"bytes=100-150", 100, 0, 0, true}, // start out of bounds
+		{"bytes=-10-20", 100, 0, 0, true},  // negative start
+		{"", 100, 0, 0, false},             // empty header
 	}
 	for _, tt := range tests {
 		start, end, err := ParseRangeHeader(tt.header, tt.size)
@@ -47,4 +62,109 @@ func TestParseRangeHeader(t *testing.T) {
 			}
 		}
 	}
-}
\ No newline at end of file
+}
+func TestParseRanges(t *testing.T) {
+	tests := []struct {
+		header  string
+		size    int64
+		want    []ByteRange
+		wantErr bool
+	}{
+		{"bytes=0-9", 100, []ByteRange{{0, 9}}, false},
+		{"bytes=0-9, 20-29", 100, []ByteRange{{0, 9}, {20, 29}}, false},
+		{"bytes=20-29,0-9", 100, []ByteRange{{0, 9}, {20, 29}}, false}, // sorted
+		{"bytes=0-9,5-19,20-29", 100, []ByteRange{{0, 29}}, false},     // overlapping and adjacent
+		{"bytes=0-,-10", 100, []ByteRange{{0, 99}}, false},
+		{"bytes=-200", 100, []ByteRange{{0, 99}}, false}, // suffix longer than the file
+		{"bytes=0-9,,", 100, []ByteRange{{0, 9}}, false},
+		{"bytes=0-9,x", 100, nil, true},
+		{"bytes=0-9,100-", 100, []ByteRange{{0, 9}}, false}, // unsatisfiable ranges are dropped
+		{"bytes=0-100", 10, []ByteRange{{0, 9}}, false},
+		{"bytes=0-4,50-60", 10, []ByteRange{{0, 4}}, false},
+		{"bytes=50-60,-0", 10, nil, true},
+		{"bytes=5-3", 10, nil, true},
+		{"items=0-9", 100, nil, true},
+		{"bytes=", 100, nil, true},
+		{"bytes=0-0,2-2,4-4,6-6", 100, nil, true}, // more than 3 ranges
+	}
+	for _, tt := range tests {
+		got, err := ParseRanges(tt.header, tt.size, 3)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRanges(%q, %d) error = %v, wantErr %v", tt.header, tt.size, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRanges(%q, %d) = %v, want %v", tt.header, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		typ  string
+		name string
+		want string
+	}{
+		{"inline", "report.pdf", `inline; filename="report.pdf"`},
+		{"attachment", `say "hi".txt`, `attachment; filename="say _hi_.txt"; filename*=UTF-8''say%20%22hi%22.txt`},
+		{"attachment", `report "final".pdf`, `attachment; filename="report _final_.pdf"; filename*=UTF-8''report%20%22final%22.pdf`},
+		{"inline", `back\slash.txt`, `inline; filename="back_slash.txt"; filename*=UTF-8''back%5Cslash.txt`},
+		{"attachment", "naïve résumé.pdf", `attachment; filename="na_ve r_sum_.pdf"; filename*=UTF-8''na%C3%AFve%20r%C3%A9sum%C3%A9.pdf`},
+		{"attachment", "日本.txt", `attachment; filename="__.txt"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.txt`},
+	}
+	for _, tt := range tests {
+		if got := ContentDisposition(tt.typ, tt.name); got != tt.want {
+			t.Errorf("ContentDisposition(%q, %q) = %s, want %s", tt.typ, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeviceName(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      string
+	}{
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1", "iPhone"},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 7 Build/UQ1A.240205.004) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/122.0 Mobile Safari/537.36", "Pixel 7"},
+		{"Mozilla/5.0 (Linux; Android 10; K) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/122.0 Mobile Safari/537.36", "Android phone"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15", "Mac"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/122.0 Safari/537.36", "Windows PC"},
+		{"curl/8.5.0", "curl"},
+		{"", "Unknown device"},
+	}
+	for _, tt := range tests {
+		if got := DeviceName(tt.userAgent); got != tt.want {
+			t.Errorf("DeviceName(%q) = %q, want %q", tt.userAgent, got, tt.want)
+		}
+	}
+}
+
+func TestRenameNoReplace(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	os.WriteFile(src, []byte("new"), 0o644)
+	os.WriteFile(dst, []byte("old"), 0o644)
+
+	if err := RenameNoReplace(src, dst); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Expected fs.ErrExist, got %v", err)
+	}
+	if data, _ := os.ReadFile(dst); string(data) != "old" {
+		t.Errorf("Expected dst to be left alone, got %q", data)
+	}
+
+	os.Remove(dst)
+	if err := RenameNoReplace(src, dst); err != nil {
+		t.Fatalf("RenameNoReplace returned error: %v", err)
+	}
+	if data, _ := os.ReadFile(dst); string(data) != "new" {
+		t.Errorf("Expected src at dst, got %q", data)
+	}
+	if _, err := os.Lstat(src); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected src to be gone, got %v", err)
+	}
+
+	os.Mkdir(src, 0o755)
+	if err := RenameNoReplace(src, dst); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Expected fs.ErrExist for a folder, got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.sakib.dev/le/logger"
+)
+
+const (
+	// approvalRetryAfter is how often clients waiting for approval check back.
+	approvalRetryAfter = 2 * time.Second
+
+	// a waiting client that stopped checking back for approvalStaleAfter is
+	// forgotten
+	approvalStaleAfter = time.Minute
+
+	// at most maxPendingApprovals clients wait at once, others are asked to
+	// check back without being shown. Once maxApprovals clients are known the
+	// denied ones seen longest ago are forgotten.
+	maxPendingApprovals = 16
+	maxApprovals        = 1024
+)
+
+var ErrUnknownClient = errors.New("no such client")
+
+type approvalStatus int
+
+const (
+	approvalPending approvalStatus = iota
+	approvalGranted
+	approvalDenied
+)
+
+// Approvals holds new clients until they are approved or denied, like
+// AirDrop does. Decisions are remembered by IP for as long as the Approvals
+// live. Requests from the machine itself are always let in.
+type Approvals struct {
+	mu      sync.Mutex
+	clients map[string]*approval // by IP
+}
+
+type approval struct {
+	status   approvalStatus
+	client   Client
+	lastSeen time.Time
+}
+
+func NewApprovals() *Approvals {
+	return &Approvals{clients: make(map[string]*approval)}
+}
+
+// check returns the decision for client, a client seen for the first time is
+// added as pending and reported as new.
+func (a *Approvals) check(client *Client) (status approvalStatus, isNew bool) {
+	if ip := net.ParseIP(client.IP); ip != nil && ip.IsLoopback() {
+		return approvalGranted, false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if ap, ok := a.clients[client.IP]; ok {
+		ap.lastSeen = now
+		return ap.status, false
+	}
+
+	a.prune(now)
+	if a.countPending() >= maxPendingApprovals || len(a.clients) >= maxApprovals {
+		return approvalPending, false
+	}
+
+	a.clients[client.IP] = &approval{status: approvalPending, client: *client, lastSeen: now}
+	return approvalPending, true
+}
+
+// prune forgets waiting clients that stopped checking back and, when too many
+// clients are known, the denied ones seen longest ago. The caller must hold mu.
+func (a *Approvals) prune(now time.Time) {
+	var denied []string
+	for ip, ap := range a.clients {
+		switch {
+		case ap.status == approvalPending && now.Sub(ap.lastSeen) > approvalStaleAfter:
+			delete(a.clients, ip)
+		case ap.status == approvalDenied:
+			denied = append(denied, ip)
+		}
+	}
+
+	if excess := len(a.clients) - maxApprovals + 1; excess > 0 {
+		slices.SortFunc(denied, func(x, y string) int {
+			return a.clients[x].lastSeen.Compare(a.clients[y].lastSeen)
+		})
+		for _, ip := range denied[:min(excess, len(denied))] {
+			delete(a.clients, ip)
+		}
+	}
+}
+
+// countPending returns the number of waiting clients. The caller must hold mu.
+func (a *Approvals) countPending() int {
+	n := 0
+	for _, ap := range a.clients {
+		if ap.status == approvalPending {
+			n++
+		}
+	}
+	return n
+}
+
+// Pending returns the clients waiting for a decision, the longest waiting
+// first.
+func (a *Approvals) Pending() []Client {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.prune(time.Now())
+
+	var pending []Client
+	for _, ap := range a.clients {
+		if ap.status == approvalPending {
+			pending = append(pending, ap.client)
+		}
+	}
+
+	slices.SortFunc(pending, func(x, y Client) int {
+		return x.ConnectedAt.Compare(y.ConnectedAt)
+	})
+	return pending
+}
+
+// Approve lets the client with ip in.
+func (a *Approvals) Approve(ip string) error {
+	return a.decide(ip, approvalGranted)
+}
+
+// Deny turns the client with ip away with 403 Forbidden.
+func (a *Approvals) Deny(ip string) error {
+	return a.decide(ip, approvalDenied)
+}
+
+func (a *Approvals) decide(ip string, status approvalStatus) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ap, ok := a.clients[ip]
+	if !ok {
+		return ErrUnknownClient
+	}
+	ap.status = status
+	return nil
+}
+
+type WaitingPageData struct {
+	Device       string
+	RetrySeconds int
+}
+
+// checkApproval reports whether the client may go on. Otherwise it answered
+// with a page that waits for the decision or with 403 Forbidden.
+func (h handler) checkApproval(reqHelper *reqHelper, client *Client) bool {
+	status, isNew := h.approvals.check(client)
+	if isNew {
+		reqHelper.log.InfoContext(reqHelper.ctx, "APPROVAL REQUESTED", "clientIP", client.IP, "device", client.Device)
+		reqHelper.send(EventApprovalRequest{Client: client, Time: time.Now()})
+	}
+
+	switch status {
+	case approvalGranted:
+		return true
+	case approvalDenied:
+		reqHelper.error("FORBIDDEN", nil, http.StatusForbidden)
+		return false
+	}
+
+	w := reqHelper.w
+	w.Header().Set("Retry-After", strconv.Itoa(int(approvalRetryAfter.Seconds())))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+
+	reqHelper.log.InfoContext(reqHelper.ctx, "WAITING FOR APPROVAL", "clientIP", client.IP, logger.StatusCodeKey, http.StatusServiceUnavailable)
+
+	if reqHelper.r.Method == http.MethodHead {
+		return false
+	}
+
+	data := WaitingPageData{Device: client.Device, RetrySeconds: int(approvalRetryAfter.Seconds())}
+	if err := waitingTemplate.Execute(w, data); err != nil {
+		reqHelper.log.ErrorContext(reqHelper.ctx, "Error rendering waiting page", "error", err)
+	}
+	return false
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.sakib.dev/le/logger"
+	"go.sakib.dev/le/pkg/utils"
+)
+
+const zipPath = internalPrefix + "zip"
+
+type archiveFormat string
+
+const (
+	archiveZip   archiveFormat = "zip"
+	archiveTarGz archiveFormat = "tar.gz"
+)
+
+var ErrUnknownArchiveFormat = errors.New("unknown archive format")
+
+func parseArchiveFormat(s string) (archiveFormat, error) {
+	switch archiveFormat(s) {
+	case archiveZip, archiveTarGz:
+		return archiveFormat(s), nil
+	}
+	return "", ErrUnknownArchiveFormat
+}
+
+func (f archiveFormat) contentType() string {
+	if f == archiveZip {
+		return "application/zip"
+	}
+	return "application/gzip"
+}
+
+// archiveEntry is a file or folder to be written into an archive.
+type archiveEntry struct {
+	src  string // name in the served file system
+	name string // slash separated path inside the archive
+	info fs.FileInfo
+}
+
+// collectArchiveEntries walks the entry at urlPath and returns everything that
+// should go into an archive under the name prefix, together with the total
+// size of all files. Hidden entries are skipped just like in the directory
+// listing. Symlinks are followed only when they point to a file inside the
+// served directory.
+func (h handler) collectArchiveEntries(urlPath, prefix string) ([]archiveEntry, int64, error) {
+	root, err := h.readable(urlPath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := fs.Stat(h.fsys, root)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !info.IsDir() {
+		return []archiveEntry{{src: root, name: prefix, info: info}}, info.Size(), nil
+	}
+
+	var entries []archiveEntry
+	var total int64
+
+	err = fs.WalkDir(h.fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel := p
+		if root != "." {
+			rel = strings.TrimPrefix(strings.TrimPrefix(p, root), "/")
+		}
+
+		if p != root && (h.isHidden(d.Name()) || isStateDir(p)) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		symlink := d.Type()&fs.ModeSymlink != 0
+		if symlink {
+			if _, err := h.readable(p); err != nil {
+				return nil
+			}
+		}
+
+		info, err := fs.Stat(h.fsys, p)
+		if err != nil {
+			return nil
+		}
+
+		if info.IsDir() && symlink {
+			// directories behind symlinks are skipped to avoid cycles
+			return nil
+		}
+
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		entries = append(entries, archiveEntry{src: p, name: path.Join(prefix, rel), info: info})
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+
+	return entries, total, err
+}
+
+// writeArchive streams entries to w in the given format without buffering the
+// archive anywhere.
+func writeArchive(w io.Writer, fsys fs.FS, format archiveFormat, entries []archiveEntry) error {
+	if format == archiveZip {
+		return writeZip(w, fsys, entries)
+	}
+	return writeTarGz(w, fsys, entries)
+}
+
+func writeZip(w io.Writer, fsys fs.FS, entries []archiveEntry) error {
+	zw := zip.NewWriter(w)
+
+	for _, entry := range entries {
+		header, err := zip.FileInfoHeader(entry.info)
+		if err != nil {
+			return err
+		}
+		header.Name = entry.name
+
+		if entry.info.IsDir() {
+			header.Name += "/"
+			header.Method = zip.Store
+			if _, err := zw.CreateHeader(header); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// compressing media and archives again is a waste of time
+		header.Method = zip.Deflate
+		if isArchiveFile(entry.name) || isImageFile(entry.name) || isVideoFile(entry.name) || isAudioFile(entry.name) {
+			header.Method = zip.Store
+		}
+
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if err := copyFile(fw, fsys, entry.src, -1); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func writeTarGz(w io.Writer, fsys fs.FS, entries []archiveEntry) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	for _, entry := range entries {
+		header, err := tar.FileInfoHeader(entry.info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = entry.name
+		if entry.info.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !entry.info.IsDir() {
+			// the header promised this many bytes, even if the file changed since
+			if err := copyFile(tw, fsys, entry.src, header.Size); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// copyFile writes the file name in fsys to w. If size is not negative exactly
+// that many bytes are copied.
+func copyFile(w io.Writer, fsys fs.FS, name string, size int64) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if size < 0 {
+		_, err = io.Copy(w, f)
+		return err
+	}
+
+	_, err = io.CopyN(w, f, size)
+	return err
+}
+
+// archiveName returns the download file name for an archive of urlPath.
+func (h handler) archiveName(urlPath string, format archiveFormat) string {
+	name := path.Base(path.Clean("/" + urlPath))
+	if name == "/" {
+		name = filepath.Base(h.root)
+	}
+	if name == "/" || name == "." {
+		name = "files"
+	}
+	return name + "." + string(format)
+}
+
+// serveArchive streams the directory at the request path as an archive.
+func (h handler) serveArchive(reqHelper *reqHelper, format archiveFormat) {
+	urlPath := reqHelper.r.URL.Path
+	fileName := h.archiveName(urlPath, format)
+
+	entries, total, err := h.collectArchiveEntries(urlPath, strings.TrimSuffix(fileName, "."+string(format)))
+	if errors.Is(err, utils.ErrForbiddenPath) {
+		reqHelper.error("FORBIDDEN", err, http.StatusForbidden)
+		return
+	} else if errors.Is(err, fs.ErrNotExist) {
+		reqHelper.error("NOT FOUND", err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		reqHelper.internalServerError(err)
+		return
+	}
+
+	h.streamArchive(reqHelper, fileName, format, entries, total)
+}
+
+// streamArchive writes entries as an archive download. total is the size of all
+// files and only an estimate of the archive size, so no Content-Length is sent.
+func (h handler) streamArchive(reqHelper *reqHelper, fileName string, format archiveFormat, entries []archiveEntry, total int64) {
+	w := reqHelper.w
+
+	w.Header().Set("Content-Type", format.contentType())
+	w.Header().Set("Content-Disposition", utils.ContentDisposition(string(DispositionAttachment), fileName))
+
+	reqHelper.log.InfoContext(reqHelper.ctx, "ARCHIVE", "file", fileName, "entries", len(entries), "estimatedSize", total, logger.StatusCodeKey, http.StatusOK)
+
+	if reqHelper.r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var transferStart = time.Now()
+	reqHelper.publishDownloadStart(fileName, total, 0, total-1)
+
+	pw := newProgressWriter(w, reqHelper, fileName, -1)
+	if err := writeArchive(pw, h.fsys, format, entries); err != nil {
+		// the response has started already, all we can do is to stop
+		reqHelper.log.ErrorContext(reqHelper.ctx, "Error writing archive", "error", err, "file", fileName, "sent", pw.sent)
+		reqHelper.publishDownloadFailed(fileName, pw.sent, err)
+		return
+	}
+
+	reqHelper.publishDownloadComplete(fileName, pw.sent, time.Since(transferStart))
+
+	reqHelper.log.InfoContext(reqHelper.ctx, "TRANSFER COMPLETE", "file", fileName, "totalSent_mb", float64(pw.sent)/1024/1024, "duration", time.Since(transferStart))
+}
+
+// serveSelectionArchive streams the entries posted as "paths" in a single zip
+// archive. Every path is validated before anything is written.
+func (h handler) serveSelectionArchive(reqHelper *reqHelper) {
+	r := reqHelper.r
+
+	if r.Method != http.MethodPost {
+		reqHelper.w.Header().Set("Allow", http.MethodPost)
+		reqHelper.error("Method Not Allowed", nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		reqHelper.error("Bad Request", err, http.StatusBadRequest)
+		return
+	}
+
+	paths := r.PostForm["paths"]
+	if len(paths) == 0 {
+		reqHelper.error("Nothing selected", nil, http.StatusBadRequest)
+		return
+	}
+
+	var entries []archiveEntry
+	var total int64
+	seen := make(map[string]bool)
+	usedNames := make(map[string]bool)
+
+	for _, p := range paths {
+		p = path.Clean("/" + p)
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+
+		if p == "/" {
+			reqHelper.error("Invalid selection", nil, http.StatusBadRequest)
+			return
+		}
+
+		name := path.Base(p)
+		for i := 1; usedNames[name]; i++ {
+			ext := path.Ext(path.Base(p))
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(path.Base(p), ext), i, ext)
+		}
+		usedNames[name] = true
+
+		selected, size, err := h.collectArchiveEntries(p, name)
+		if errors.Is(err, utils.ErrForbiddenPath) {
+			reqHelper.error("FORBIDDEN", err, http.StatusForbidden)
+			return
+		} else if errors.Is(err, fs.ErrNotExist) {
+			reqHelper.error("NOT FOUND", err, http.StatusNotFound)
+			return
+		} else if err != nil {
+			reqHelper.internalServerError(err)
+			return
+		}
+
+		entries = append(entries, selected...)
+		total += size
+	}
+
+	fileName := h.archiveName(path.Dir(path.Clean("/"+paths[0])), archiveZip)
+	h.streamArchive(reqHelper, fileName, archiveZip, entries, total)
+}
@@ -0,0 +1,436 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+var errArchiveNotSeekable = errors.New("archive can't be read without seeking")
+
+// browsableArchiveExts are the archives whose members can be browsed.
+var browsableArchiveExts = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+
+func isBrowsableArchive(name string) bool {
+	name = strings.ToLower(name)
+	return slices.ContainsFunc(browsableArchiveExts, func(ext string) bool {
+		return strings.HasSuffix(name, ext)
+	})
+}
+
+// splitArchivePath splits name at the first segment that looks like a
+// browsable archive into the archive and the member inside it, "." for the
+// archive itself.
+func splitArchivePath(name string) (archive, member string, ok bool) {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		if isBrowsableArchive(segment) {
+			member = path.Join(segments[i+1:]...)
+			if member == "" {
+				member = "."
+			}
+			return path.Join(segments[:i+1]...), member, true
+		}
+	}
+	return "", "", false
+}
+
+// archiveFS extends a file system with the members of the zip and tar
+// archives in it, e.g. "builds/app.zip/bin/app". Names that exist in the
+// underlying file system always win. Reading a directory that is an archive
+// lists the archive's top level.
+//
+// Members are read in place where the format allows it, which keeps range
+// requests working for uncompressed tar archives and stored zip members.
+// Everything else is decompressed on the fly and can't seek.
+type archiveFS struct {
+	fs.FS
+}
+
+func (a archiveFS) Open(name string) (fs.File, error) {
+	f, err := a.FS.Open(name)
+	if err == nil {
+		return f, nil
+	}
+
+	archive, member, ok := splitArchivePath(name)
+	if !ok || member == "." {
+		return nil, err
+	}
+
+	arc, aerr := a.openArchive(archive)
+	if aerr != nil {
+		return nil, err
+	}
+
+	// the member keeps the archive open until it is closed itself
+	f, err = arc.Open(member)
+	if err != nil {
+		arc.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f, nil
+}
+
+func (a archiveFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(a.FS, name)
+	if err == nil {
+		return entries, nil
+	}
+
+	archive, member, ok := splitArchivePath(name)
+	if !ok {
+		return nil, err
+	}
+
+	arc, aerr := a.openArchive(archive)
+	if aerr != nil {
+		return nil, err
+	}
+	defer arc.Close()
+
+	return fs.ReadDir(arc, member)
+}
+
+// inArchive reports whether the directory name is an archive or lies inside
+// one rather than in the underlying file system.
+func (a archiveFS) inArchive(name string) bool {
+	if _, _, ok := splitArchivePath(name); !ok {
+		return false
+	}
+	info, err := fs.Stat(a.FS, name)
+	return err != nil || !info.IsDir()
+}
+
+func (h handler) inArchive(name string) bool {
+	afs, ok := h.fsys.(archiveFS)
+	return ok && afs.inArchive(name)
+}
+
+// openedArchive is the file system of a single archive. Closing it closes the
+// archive file, and so does closing any member opened from it.
+type openedArchive interface {
+	fs.FS
+	io.Closer
+}
+
+func (a archiveFS) openArchive(name string) (openedArchive, error) {
+	f, err := a.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var arc openedArchive
+	if strings.HasSuffix(strings.ToLower(name), ".zip") {
+		arc, err = openZip(f, info)
+	} else {
+		arc, err = openTar(f, info, !strings.HasSuffix(strings.ToLower(name), ".tar"))
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return arc, nil
+}
+
+// readerAt returns f as an io.ReaderAt if it can be read at random offsets.
+func readerAt(f fs.File) io.ReaderAt {
+	if ra, ok := f.(io.ReaderAt); ok {
+		return ra
+	}
+	if rs, ok := f.(io.ReadSeeker); ok {
+		return seekReaderAt{rs}
+	}
+	return nil
+}
+
+type zipArchive struct {
+	*zip.Reader
+	file   fs.File
+	ra     io.ReaderAt
+	stored map[string]*zip.File
+}
+
+func openZip(f fs.File, info fs.FileInfo) (*zipArchive, error) {
+	ra := readerAt(f)
+	if ra == nil {
+		return nil, errArchiveNotSeekable
+	}
+
+	zr, err := zip.NewReader(ra, info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	z := &zipArchive{Reader: zr, file: f, ra: ra, stored: make(map[string]*zip.File)}
+	for _, zf := range zr.File {
+		// encrypted members aren't supported by archive/zip anyway
+		if zf.Method == zip.Store && zf.Flags&0x1 == 0 && !strings.HasSuffix(zf.Name, "/") && fs.ValidPath(zf.Name) {
+			z.stored[zf.Name] = zf
+		}
+	}
+
+	return z, nil
+}
+
+func (z *zipArchive) Open(name string) (fs.File, error) {
+	if zf, ok := z.stored[name]; ok {
+		offset, err := zf.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		section := io.NewSectionReader(z.ra, offset, int64(zf.UncompressedSize64))
+		return &sectionFile{SectionReader: section, info: zf.FileInfo(), archive: z}, nil
+	}
+
+	f, err := z.Reader.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &memberFile{File: f, archive: z}, nil
+}
+
+func (z *zipArchive) Close() error {
+	return z.file.Close()
+}
+
+type tarArchive struct {
+	file    fs.File
+	info    fs.FileInfo
+	tr      *tar.Reader
+	seeker  io.Seeker   // set while the archive can be read in place
+	ra      io.ReaderAt // set while the archive can be read in place
+	members map[string]*tarMember
+	done    bool
+}
+
+type tarMember struct {
+	info     fs.FileInfo
+	offset   int64
+	children []string
+}
+
+func openTar(f fs.File, info fs.FileInfo, compressed bool) (*tarArchive, error) {
+	t := &tarArchive{
+		file: f,
+		info: info,
+		members: map[string]*tarMember{
+			".": {info: implicitDir{name: path.Base(info.Name()), modTime: info.ModTime()}},
+		},
+	}
+
+	if compressed {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		t.tr = tar.NewReader(gr)
+		return t, nil
+	}
+
+	t.tr = tar.NewReader(f)
+	if seeker, ok := f.(io.Seeker); ok {
+		t.seeker, t.ra = seeker, readerAt(f)
+	}
+	return t, nil
+}
+
+// next indexes the next regular file or directory in the archive.
+func (t *tarArchive) next() (string, error) {
+	for {
+		hdr, err := t.tr.Next()
+		if err == io.EOF {
+			t.done = true
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir {
+			continue
+		}
+		name := strings.TrimSuffix(path.Clean(strings.TrimPrefix(hdr.Name, "./")), "/")
+		if !fs.ValidPath(name) || name == "." {
+			continue
+		}
+
+		var offset int64
+		if t.seeker != nil {
+			if offset, err = t.seeker.Seek(0, io.SeekCurrent); err != nil {
+				return "", err
+			}
+		}
+
+		t.add(name, hdr.FileInfo(), offset)
+		return name, nil
+	}
+}
+
+// add records a member and all directories leading to it.
+func (t *tarArchive) add(name string, info fs.FileInfo, offset int64) {
+	if m, ok := t.members[name]; ok {
+		// a later entry replaces an earlier one, just like when extracting
+		m.info, m.offset = info, offset
+		return
+	}
+	t.members[name] = &tarMember{info: info, offset: offset}
+
+	for name != "." {
+		parent := path.Dir(name)
+		p, ok := t.members[parent]
+		if !ok {
+			p = &tarMember{info: implicitDir{name: path.Base(parent), modTime: t.info.ModTime()}}
+			t.members[parent] = p
+		}
+		p.children = append(p.children, name)
+		if ok {
+			return
+		}
+		name = parent
+	}
+}
+
+func (t *tarArchive) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	for !t.done {
+		member, err := t.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		// without seeking a file can only be read while the reader is on it
+		if member == name && t.seeker == nil && !t.members[name].info.IsDir() {
+			return &memberFile{File: streamFile{Reader: t.tr, info: t.members[name].info}, archive: t}, nil
+		}
+	}
+
+	m, ok := t.members[name]
+	switch {
+	case !ok:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case m.info.IsDir():
+		entries := make([]fs.DirEntry, 0, len(m.children))
+		for _, child := range m.children {
+			entries = append(entries, fs.FileInfoToDirEntry(t.members[child].info))
+		}
+		slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+			return strings.Compare(a.Name(), b.Name())
+		})
+		return &memberFile{File: &dirFile{info: m.info, entries: entries}, archive: t}, nil
+	case t.ra != nil:
+		section := io.NewSectionReader(t.ra, m.offset, m.info.Size())
+		return &sectionFile{SectionReader: section, info: m.info, archive: t}, nil
+	default:
+		// a compressed archive can't go back to a member it has passed
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errArchiveNotSeekable}
+	}
+}
+
+func (t *tarArchive) Close() error {
+	return t.file.Close()
+}
+
+// sectionFile is a member stored uncompressed, it supports seeking.
+type sectionFile struct {
+	*io.SectionReader
+	info    fs.FileInfo
+	archive io.Closer
+}
+
+func (f *sectionFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *sectionFile) Close() error {
+	return f.archive.Close()
+}
+
+// memberFile is any other member, it only supports reading in order.
+type memberFile struct {
+	fs.File
+	archive io.Closer
+}
+
+func (f *memberFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	dir, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		info, _ := f.Stat()
+		return nil, &fs.PathError{Op: "readdir", Path: info.Name(), Err: errors.New("not a directory")}
+	}
+	return dir.ReadDir(n)
+}
+
+func (f *memberFile) Close() error {
+	f.File.Close()
+	return f.archive.Close()
+}
+
+type streamFile struct {
+	io.Reader
+	info fs.FileInfo
+}
+
+func (f streamFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f streamFile) Close() error               { return nil }
+
+type dirFile struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// implicitDir describes a directory that has no entry of its own in an
+// archive, e.g. the parents of "a/b/c.txt".
+type implicitDir struct {
+	name    string
+	modTime time.Time
+}
+
+func (d implicitDir) Name() string       { return d.name }
+func (d implicitDir) Size() int64        { return 0 }
+func (d implicitDir) Mode() fs.FileMode  { return fs.ModeDir | 0o555 }
+func (d implicitDir) ModTime() time.Time { return d.modTime }
+func (d implicitDir) IsDir() bool        { return true }
+func (d implicitDir) Sys() any           { return nil }
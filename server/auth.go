@@ -0,0 +1,250 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.sakib.dev/le/pkg/nanoid"
+	"go.sakib.dev/le/pkg/utils"
+)
+
+const (
+	sessionCookieName = "le_session"
+	sessionLifetime   = 24 * time.Hour
+
+	// tokenParam is the query parameter carrying the access token.
+	tokenParam = "token"
+	tokenLen   = 22
+
+	// a client that fails maxAuthFailures times within authFailureWindow is
+	// turned away until the window has passed
+	maxAuthFailures   = 5
+	authFailureWindow = time.Minute
+)
+
+// NewToken returns a random access token.
+func NewToken() string {
+	return nanoid.NewWithLen(tokenLen)
+}
+
+// AccessControl protects the handler with a password for HTTP Basic auth, an
+// access token or both. The token may be given as ?token= or as a Bearer
+// token. Either way the client gets an HttpOnly session cookie, so browsers
+// only need the token on their first visit. Clients with too many failed
+// attempts are rate limited by IP.
+//
+// Check is an AuthFunc, use it with WithAuth.
+type AccessControl struct {
+	password string
+	token    string
+
+	mu       sync.Mutex
+	sessions map[string]time.Time // session ID to expiry
+	limiter  failureLimiter
+}
+
+// failureLimiter turns clients away after too many failed attempts. The zero
+// value is ready to use.
+type failureLimiter struct {
+	mu       sync.Mutex
+	failures map[string]*authFailures // by client IP
+}
+
+type authFailures struct {
+	count int
+	since time.Time
+}
+
+// NewAccessControl returns an AccessControl for password and token, either may
+// be empty.
+func NewAccessControl(password, token string) *AccessControl {
+	return &AccessControl{
+		password: password,
+		token:    token,
+		sessions: make(map[string]time.Time),
+	}
+}
+
+func (a *AccessControl) Check(w http.ResponseWriter, r *http.Request) bool {
+	ip, err := utils.GetClientIP(r)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	// failures of others behind the same IP don't lock out a session
+	if a.validSession(r) {
+		return true
+	}
+
+	if a.limiter.reject(w, ip) {
+		return false
+	}
+
+	ok, presented := a.checkCredentials(r)
+	if ok {
+		a.startSession(w, r)
+
+		// drop the token from the address bar, the cookie takes over
+		if r.URL.Query().Has(tokenParam) && r.Method == http.MethodGet && isBrowser(r) {
+			w.Header().Set("Location", withoutToken(r.URL))
+			w.WriteHeader(http.StatusSeeOther)
+			return false
+		}
+		return true
+	}
+
+	if presented {
+		a.limiter.fail(ip)
+	}
+
+	if a.password != "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="le", charset="UTF-8"`)
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// checkCredentials reports whether r carries a valid password or token and
+// whether it carries any at all.
+func (a *AccessControl) checkCredentials(r *http.Request) (ok, presented bool) {
+	if a.token != "" {
+		if token := r.URL.Query().Get(tokenParam); token != "" {
+			return secureEqual(token, a.token), true
+		}
+		if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+			return secureEqual(token, a.token), true
+		}
+	}
+
+	if a.password != "" {
+		if _, password, found := r.BasicAuth(); found {
+			return secureEqual(password, a.password), true
+		}
+	}
+
+	return false, r.Header.Get("Authorization") != "" || r.URL.Query().Has(tokenParam)
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (a *AccessControl) validSession(r *http.Request) bool {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	expires, ok := a.sessions[cookie.Value]
+	return ok && time.Now().Before(expires)
+}
+
+func (a *AccessControl) startSession(w http.ResponseWriter, r *http.Request) {
+	id := nanoid.NewWithLen(tokenLen)
+	expires := time.Now().Add(sessionLifetime)
+
+	a.mu.Lock()
+	for sid, exp := range a.sessions {
+		if time.Now().After(exp) {
+			delete(a.sessions, sid)
+		}
+	}
+	a.sessions[id] = expires
+	a.mu.Unlock()
+
+	// the cookie is only sent to where the handler is mounted
+	cookiePath, _ := r.Context().Value(utils.BasePathKey).(string)
+	if cookiePath == "" {
+		cookiePath = "/"
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     cookiePath,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// reject answers with 429 Too Many Requests if ip has to wait before it may
+// try again.
+func (l *failureLimiter) reject(w http.ResponseWriter, ip string) bool {
+	wait := l.blocked(ip)
+	if wait <= 0 {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	http.Error(w, "Too many failed attempts", http.StatusTooManyRequests)
+	return true
+}
+
+// blocked returns how long ip has to wait before it may try again.
+func (l *failureLimiter) blocked(ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.failures[ip]
+	if !ok || f.count < maxAuthFailures {
+		return 0
+	}
+
+	wait := time.Until(f.since.Add(authFailureWindow))
+	if wait <= 0 {
+		delete(l.failures, ip)
+		return 0
+	}
+	return wait
+}
+
+func (l *failureLimiter) fail(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.failures == nil {
+		l.failures = make(map[string]*authFailures)
+	}
+	for other, f := range l.failures {
+		if time.Since(f.since) > authFailureWindow {
+			delete(l.failures, other)
+		}
+	}
+
+	f, ok := l.failures[ip]
+	if !ok {
+		f = &authFailures{since: time.Now()}
+		l.failures[ip] = f
+	}
+	f.count++
+}
+
+// withoutToken returns a relative link to u without the token parameter. It is
+// relative because u may lack the base path the handler is mounted on.
+func withoutToken(u *url.URL) string {
+	query := u.Query()
+	query.Del(tokenParam)
+
+	link := path.Base(u.Path)
+	if strings.HasSuffix(u.Path, "/") || link == "/" {
+		link = "./"
+	}
+	// escapes the name and keeps a colon from being read as a scheme
+	link = (&url.URL{Path: link}).String()
+
+	if len(query) > 0 {
+		link += "?" + query.Encode()
+	}
+	return link
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"go.sakib.dev/le/pkg/utils"
+)
+
+// Disposition decides whether browsers display a file or save it.
+type Disposition string
+
+const (
+	DispositionInline     Disposition = "inline"
+	DispositionAttachment Disposition = "attachment"
+)
+
+func ParseDisposition(s string) (Disposition, error) {
+	switch Disposition(s) {
+	case DispositionInline, DispositionAttachment:
+		return Disposition(s), nil
+	}
+	return "", fmt.Errorf("invalid disposition %q, must be %q or %q", s, DispositionInline, DispositionAttachment)
+}
+
+// sniffLen is the number of bytes http.DetectContentType looks at.
+const sniffLen = 512
+
+// detectContentType returns the MIME type of a file, first by its extension and
+// then by sniffing its content if it can be seeked back afterwards.
+func detectContentType(name string, file io.Reader) (string, error) {
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		return ctype, nil
+	}
+
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		return "application/octet-stream", nil
+	}
+
+	var buf [sniffLen]byte
+	n, err := io.ReadFull(content, buf[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// disposition returns how the file should be presented for this request. The
+// "download" query parameter overrides the server default.
+func (h handler) disposition(r *http.Request) Disposition {
+	switch r.URL.Query().Get("download") {
+	case "1", "true":
+		return DispositionAttachment
+	case "0", "false":
+		return DispositionInline
+	}
+	return h.defaultDisposition
+}
+
+// setContentHeaders sets Content-Type and Content-Disposition for a file
+// download. Files shown inline are sandboxed so an uploaded HTML page can't
+// run scripts with le's origin.
+func setContentHeaders(w http.ResponseWriter, fileName, contentType string, disposition Disposition) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", utils.ContentDisposition(string(disposition), fileName))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if disposition == DispositionInline && isActiveContent(contentType) {
+		w.Header().Set("Content-Security-Policy", "sandbox")
+	}
+}
+
+// isActiveContent reports whether browsers may execute scripts in content of
+// this type.
+func isActiveContent(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "text/html" ||
+		mediaType == "image/svg+xml" ||
+		mediaType == "application/xhtml+xml" ||
+		strings.HasSuffix(mediaType, "/xml") ||
+		strings.HasSuffix(mediaType, "+xml")
+}
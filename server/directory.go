@@ -3,8 +3,9 @@ package server
 import (
 	"embed"
 	"html/template"
+	"io/fs"
 	"net/http"
-	"os"
+	"path"
 	"path/filepath"
 	"slices"
 	"sort"
@@ -12,11 +13,15 @@ import (
 	"time"
 )
 
-//go:embed templates/directory.html
+//go:embed templates/directory.html templates/trash.html templates/waiting.html
 var templateFS embed.FS
 
 var dirTemplate = template.Must(template.ParseFS(templateFS, "templates/directory.html"))
 
+var trashTemplate = template.Must(template.ParseFS(templateFS, "templates/trash.html"))
+
+var waitingTemplate = template.Must(template.ParseFS(templateFS, "templates/waiting.html"))
+
 type FileInfo struct {
 	Name      string
 	Path      string
@@ -29,6 +34,8 @@ type FileInfo struct {
 	IsVideo   bool
 	IsArchive bool
 	IsText    bool
+	// IsBrowsable is set for archives whose members can be listed.
+	IsBrowsable bool
 }
 
 type Breadcrumb struct {
@@ -38,10 +45,17 @@ type Breadcrumb struct {
 }
 
 type DirectoryData struct {
-	Path        string
-	ParentPath  string
-	Files       []FileInfo
-	Breadcrumbs []Breadcrumb
+	Path         string
+	ParentPath   string
+	Files        []FileInfo
+	Breadcrumbs  []Breadcrumb
+	Upload       bool
+	BasePath     string // prefix of every link, set when mounted below a path
+	TusPath      string
+	TusThreshold int64
+	OpsPath      string
+	TrashPath    string
+	ZipPath      string
 }
 
 func isCodeFile(name string) bool {
@@ -164,18 +178,22 @@ func formatTime(t time.Time) string {
 	return t.Format("Jan 2, 2006")
 }
 
-func (h *handler) serveDirectory(w http.ResponseWriter, r *http.Request, dirPath string) {
-	files, err := os.ReadDir(dirPath)
+// serveDirectory lists the directory name of the served file system.
+func (h *handler) serveDirectory(w http.ResponseWriter, r *http.Request, name string) {
+	files, err := fs.ReadDir(h.fsys, name)
 	if err != nil {
 		http.Error(w, "Error reading directory", http.StatusInternalServerError)
 		return
 	}
 
+	// archives are read-only and can't be nested
+	inArchive := h.inArchive(name)
+
 	var dirs, regularFiles []FileInfo
 
 	for _, file := range files {
 
-		if strings.HasPrefix(file.Name(), ".") {
+		if h.isHidden(file.Name()) || isStateDir(path.Join(name, file.Name())) {
 			continue
 		}
 
@@ -206,6 +224,7 @@ func (h *handler) serveDirectory(w http.ResponseWriter, r *http.Request, dirPath
 			fileInfo.IsAudio = isAudioFile(file.Name())
 			fileInfo.IsVideo = isVideoFile(file.Name())
 			fileInfo.IsArchive = isArchiveFile(file.Name())
+			fileInfo.IsBrowsable = !inArchive && isBrowsableArchive(file.Name())
 			fileInfo.IsText = isTextFile(file.Name())
 			regularFiles = append(regularFiles, fileInfo)
 		}
@@ -249,10 +268,20 @@ func (h *handler) serveDirectory(w http.ResponseWriter, r *http.Request, dirPath
 	}
 
 	data := DirectoryData{
-		Path:        r.URL.Path,
-		ParentPath:  parentPath,
-		Files:       allFiles,
-		Breadcrumbs: breadcrumbs,
+		Path:         r.URL.Path,
+		ParentPath:   parentPath,
+		Files:        allFiles,
+		Breadcrumbs:  breadcrumbs,
+		Upload:       h.upload && !inArchive,
+		BasePath:     h.basePath,
+		TusPath:      h.url(tusPath),
+		TusThreshold: tusThreshold,
+		OpsPath:      h.url(opsPath),
+		ZipPath:      h.url(zipPath),
+	}
+
+	if h.trash != nil {
+		data.TrashPath = h.url(trashPath)
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"go.sakib.dev/le/logger"
+	"go.sakib.dev/le/pkg/utils"
+)
+
+const opsPath = internalPrefix + "fs/"
+
+// FileOp is a file management action a client can perform in read-write mode.
+type FileOp string
+
+const (
+	FileOpMkdir   FileOp = "mkdir"
+	FileOpRename  FileOp = "rename"
+	FileOpMove    FileOp = "move"
+	FileOpDelete  FileOp = "delete"
+	FileOpRestore FileOp = "restore"
+)
+
+var (
+	ErrEntryExists   = errors.New("entry already exists")
+	ErrInvalidTarget = errors.New("invalid target")
+)
+
+// resolveEntry maps a URL path onto its name in h.wfs like resolve, but only
+// resolves symlinks in the parent directory. Operations on a symlink affect the
+// link itself, not the file it points to.
+func (h handler) resolveEntry(urlPath string) (string, error) {
+	urlPath = path.Clean("/" + urlPath)
+	if urlPath == "/" {
+		return "", ErrInvalidTarget
+	}
+
+	parent, err := h.resolve(path.Dir(urlPath))
+	if err != nil {
+		return "", err
+	}
+
+	if h.hidden == HiddenDeny && hasHiddenSegment(urlPath) {
+		return "", utils.ErrForbiddenPath
+	}
+
+	entry := path.Join(parent, path.Base(urlPath))
+	if isStateDir(entry) {
+		return "", utils.ErrForbiddenPath
+	}
+
+	return entry, nil
+}
+
+// serveFileOp handles POST /.le/fs/<op> with form values "path" and, depending
+// on the operation, "name" or "dest".
+func (h handler) serveFileOp(reqHelper *reqHelper, op FileOp) {
+	r := reqHelper.r
+
+	if r.Method != http.MethodPost {
+		reqHelper.w.Header().Set("Allow", http.MethodPost)
+		reqHelper.error("Method Not Allowed", nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	urlPath := path.Clean("/" + r.PostFormValue("path"))
+
+	var target string
+	var err error
+	switch op {
+	case FileOpMkdir:
+		target, err = h.mkdir(urlPath, r.PostFormValue("name"))
+	case FileOpRename:
+		target, err = h.rename(urlPath, r.PostFormValue("name"))
+	case FileOpMove:
+		target, err = h.move(urlPath, r.PostFormValue("dest"))
+	case FileOpDelete:
+		err = h.delete(urlPath)
+	default:
+		reqHelper.error("NOT FOUND", nil, http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case err == nil:
+	case errors.Is(err, utils.ErrForbiddenPath):
+		reqHelper.error("FORBIDDEN", err, http.StatusForbidden)
+		return
+	case errors.Is(err, os.ErrNotExist):
+		reqHelper.error("NOT FOUND", err, http.StatusNotFound)
+		return
+	case errors.Is(err, ErrEntryExists), errors.Is(err, os.ErrExist):
+		reqHelper.error("Entry already exists", err, http.StatusConflict)
+		return
+	case errors.Is(err, ErrInvalidTarget), errors.Is(err, ErrInvalidFileName):
+		reqHelper.error("Bad Request", err, http.StatusBadRequest)
+		return
+	default:
+		reqHelper.internalServerError(err)
+		return
+	}
+
+	reqHelper.publishFileOp(op, urlPath, target)
+	reqHelper.log.InfoContext(reqHelper.ctx, strings.ToUpper(string(op)), "path", urlPath, "target", target, logger.StatusCodeKey, http.StatusNoContent)
+
+	reqHelper.w.WriteHeader(http.StatusNoContent)
+}
+
+// mkdir creates the folder name inside dir and returns its URL path.
+func (h handler) mkdir(dir, name string) (string, error) {
+	name, err := cleanFileName(name)
+	if err != nil {
+		return "", err
+	}
+
+	target := path.Join(dir, name)
+	entry, err := h.resolveEntry(target)
+	if err != nil {
+		return "", err
+	}
+
+	return target, h.wfs.Mkdir(entry, 0o755)
+}
+
+// rename gives the entry at urlPath a new name in the same folder and returns
+// its new URL path.
+func (h handler) rename(urlPath, name string) (string, error) {
+	name, err := cleanFileName(name)
+	if err != nil {
+		return "", err
+	}
+
+	return h.moveEntry(urlPath, path.Join(path.Dir(urlPath), name))
+}
+
+// move puts the entry at urlPath into the folder dest and returns its new URL
+// path.
+func (h handler) move(urlPath, dest string) (string, error) {
+	dest = path.Clean("/" + dest)
+
+	destDir, err := h.resolve(dest)
+	if err != nil {
+		return "", err
+	}
+	if info, err := fs.Stat(h.wfs, destDir); err != nil {
+		return "", err
+	} else if !info.IsDir() {
+		return "", ErrInvalidTarget
+	}
+
+	return h.moveEntry(urlPath, path.Join(dest, path.Base(urlPath)))
+}
+
+func (h handler) moveEntry(from, to string) (string, error) {
+	src, err := h.resolveEntry(from)
+	if err != nil {
+		return "", err
+	}
+
+	dst, err := h.resolveEntry(to)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := h.wfs.Lstat(src); err != nil {
+		return "", err
+	}
+
+	if dst == src {
+		return to, nil
+	}
+
+	// a folder can't be moved into itself
+	if strings.HasPrefix(dst, src+"/") {
+		return "", ErrInvalidTarget
+	}
+
+	// an entry that shows up at dst meanwhile is never replaced
+	if err := h.wfs.RenameNoReplace(src, dst); errors.Is(err, fs.ErrExist) {
+		return "", ErrEntryExists
+	} else if err != nil {
+		return "", err
+	}
+	return to, nil
+}
+
+func (h handler) delete(urlPath string) error {
+	entry, err := h.resolveEntry(urlPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := h.wfs.Lstat(entry); err != nil {
+		return err
+	}
+
+	// the trash moves the entry out of the served tree
+	if h.trash != nil {
+		_, err := h.trash.Put(h.osPath(entry), urlPath, TrashReasonDelete)
+		return err
+	}
+
+	return h.wfs.RemoveAll(entry)
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"go.sakib.dev/le/pkg/utils"
+)
+
+// WritableFS is the optional extension of fs.FS for file systems clients may
+// change. Uploads, resumable uploads and file management go through its
+// methods, which take names like fs.FS does and rename or remove a symlink
+// rather than its target.
+type WritableFS interface {
+	fs.FS
+	Lstat(name string) (fs.FileInfo, error)
+	Mkdir(name string, perm fs.FileMode) error
+	// OpenFile opens name for writing with the flags of os.OpenFile.
+	OpenFile(name string, flag int, perm fs.FileMode) (io.WriteCloser, error)
+	// CreateTemp creates a new file in the folder dir whose name starts with
+	// prefix, and returns it open for writing with its name.
+	CreateTemp(dir, prefix string) (io.WriteCloser, string, error)
+	// Rename replaces newname if it is a file.
+	Rename(oldname, newname string) error
+	// RenameNoReplace is Rename but fails with fs.ErrExist rather than
+	// replacing newname.
+	RenameNoReplace(oldname, newname string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+}
+
+var (
+	ErrReadOnlyFS = errors.New("file system is not writable")
+	ErrNotOSDir   = errors.New("file system is not an OS directory")
+)
+
+// DirFS returns a writable file system for the OS directory dir. Unlike
+// os.DirFS it never follows a symlink out of dir.
+func DirFS(dir string) WritableFS {
+	return dirFS(dir)
+}
+
+type dirFS string
+
+func (d dirFS) resolve(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	absPath, err := utils.SecureJoin(string(d), name)
+	if err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return absPath, nil
+}
+
+// resolveEntry resolves the folder of name but not name itself, which may be a
+// symlink to change rather than follow.
+func (d dirFS) resolveEntry(op, name string) (string, error) {
+	if name == "." {
+		return d.resolve(op, name)
+	}
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	parent, err := d.resolve(op, path.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, path.Base(name)), nil
+}
+
+// Open returns an *os.File, which lets downloads use sendfile.
+func (d dirFS) Open(name string) (fs.File, error) {
+	absPath, err := d.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(absPath)
+}
+
+func (d dirFS) Stat(name string) (fs.FileInfo, error) {
+	absPath, err := d.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(absPath)
+}
+
+func (d dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	absPath, err := d.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(absPath)
+}
+
+func (d dirFS) Lstat(name string) (fs.FileInfo, error) {
+	absPath, err := d.resolveEntry("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(absPath)
+}
+
+func (d dirFS) Mkdir(name string, perm fs.FileMode) error {
+	absPath, err := d.resolveEntry("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(absPath, perm)
+}
+
+func (d dirFS) OpenFile(name string, flag int, perm fs.FileMode) (io.WriteCloser, error) {
+	absPath, err := d.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(absPath, flag, perm)
+}
+
+func (d dirFS) CreateTemp(dir, prefix string) (io.WriteCloser, string, error) {
+	absDir, err := d.resolve("createtemp", dir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	f, err := os.CreateTemp(absDir, prefix+"*")
+	if err != nil {
+		return nil, "", err
+	}
+	return f, path.Join(dir, filepath.Base(f.Name())), nil
+}
+
+func (d dirFS) Rename(oldname, newname string) error {
+	oldPath, err := d.resolveEntry("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newPath, err := d.resolveEntry("rename", newname)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func (d dirFS) RenameNoReplace(oldname, newname string) error {
+	oldPath, err := d.resolveEntry("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newPath, err := d.resolveEntry("rename", newname)
+	if err != nil {
+		return err
+	}
+	return utils.RenameNoReplace(oldPath, newPath)
+}
+
+func (d dirFS) Remove(name string) error {
+	absPath, err := d.resolveEntry("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(absPath)
+}
+
+func (d dirFS) RemoveAll(name string) error {
+	absPath, err := d.resolveEntry("removeall", name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(absPath)
+}
+
+// fsName converts a URL path into a name for fs.FS.
+func fsName(urlPath string) string {
+	name := strings.Trim(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func isStateDir(name string) bool {
+	return name == stateDirName || strings.HasPrefix(name, stateDirName+"/")
+}
+
+// readable checks that urlPath may be read and returns its name in h.fsys.
+// Paths in le's state directory and, with HiddenDeny, hidden paths are
+// rejected with utils.ErrForbiddenPath.
+func (h handler) readable(urlPath string) (string, error) {
+	name := fsName(urlPath)
+	if isStateDir(name) || (h.hidden == HiddenDeny && hasHiddenSegment(name)) {
+		return "", utils.ErrForbiddenPath
+	}
+
+	if h.root != "" {
+		// on disk symlinks may lead to hidden files under innocent names
+		_, err := h.resolve(urlPath)
+		if archive, _, ok := splitArchivePath(name); ok && errors.Is(err, syscall.ENOTDIR) {
+			// members of an archive are checked up to the archive file
+			_, err = h.resolve(archive)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return name, nil
+}
+
+// osPath returns the OS path of name in h.wfs. Only handlers serving an OS
+// directory have one.
+func (h handler) osPath(name string) string {
+	return filepath.Join(h.root, filepath.FromSlash(name))
+}
+
+// mkdirAll creates the folder name in fsys along with any missing parents.
+func mkdirAll(fsys WritableFS, name string, perm fs.FileMode) error {
+	if name == "." {
+		return nil
+	}
+	if err := mkdirAll(fsys, path.Dir(name), perm); err != nil {
+		return err
+	}
+
+	err := fsys.Mkdir(name, perm)
+	if errors.Is(err, fs.ErrExist) {
+		if info, statErr := fs.Stat(fsys, name); statErr == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+// seekReaderAt implements io.ReaderAt on top of a seeker for files that don't
+// support ReadAt. It may only be used by one reader at a time.
+type seekReaderAt struct {
+	rs io.ReadSeeker
+}
+
+func (s seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := s.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s.rs, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
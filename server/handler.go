@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"net/http"
-	"os"
+	"net/url"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -20,55 +22,138 @@ import (
 const downloadProgressLogInterval = 500 * time.Millisecond // Log download progress every 500 milliseconds
 
 type handler struct {
-	defaultServer http.Handler
-	root          http.Dir
-	ch            chan<- ServerEvent
-}
-
-func newHandler(dir string, ch chan<- ServerEvent) http.Handler {
-	return &handler{
-		defaultServer: http.FileServer(http.Dir(dir)),
-		root:          http.Dir(dir),
-		ch:            ch,
-	}
+	defaultServer      http.Handler
+	root               string // OS directory behind fsys, empty unless served from one
+	fsys               fs.FS
+	wfs                WritableFS // nil unless fsys is writable
+	upload             bool
+	defaultDisposition Disposition
+	hidden             HiddenPolicy
+	basePath           string
+	auth               AuthFunc
+	policy             *IPPolicy
+	approvals          *Approvals
+	shares             *Shares
+	tus                *tusStore
+	trash              *Trash
+	log                *slog.Logger
+	ch                 chan<- ServerEvent
 }
 
 func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	reqHelper := newReqHelper(w, r, h.ch)
+	reqHelper := newReqHelper(w, r, h.ch, h.log)
 
 	reqHelper.attachReqId()
 
 	clientIP, err := utils.GetClientIP(r)
 	if err != nil {
-		slog.Warn("Failed to get client IP", "error", err)
+		reqHelper.log.Warn("Failed to get client IP", "error", err)
 		clientIP = "unknown"
 	}
 
+	// the policy goes first, rejected clients don't get as far as a lookup
+	if h.policy != nil && !h.checkPolicy(reqHelper, clientIP) {
+		return
+	}
+
 	clientHost, err := utils.GetClientHostname(r)
 	if err != nil {
-		slog.Warn("Failed to get client hostname", "error", err)
+		reqHelper.log.Warn("Failed to get client hostname", "error", err)
 		clientHost = "unknown"
 	}
 
-	slog.InfoContext(reqHelper.ctx, "REQUEST",
+	reqHelper.log.InfoContext(reqHelper.ctx, "REQUEST",
 		"clientIP", clientIP,
 		"clientHost", clientHost,
 		"userAgent", r.UserAgent(),
 		"method", r.Method,
 		"path", r.URL.Path)
 
-	reqHelper.publishNewConn(clientIP, clientHost)
+	client := &Client{
+		IP:          clientIP,
+		Host:        clientHost,
+		Device:      utils.DeviceName(r.UserAgent()),
+		UserAgent:   r.UserAgent(),
+		ConnectedAt: time.Now(),
+	}
+
+	reqHelper.publishNewConn(client)
 	defer reqHelper.publishConnClose()
 
-	if r.Method != http.MethodGet {
+	if h.basePath != "" {
+		urlPath, ok := strings.CutPrefix(r.URL.Path, h.basePath)
+		if !ok || (urlPath != "" && urlPath[0] != '/') {
+			reqHelper.error("NOT FOUND", nil, http.StatusNotFound)
+			return
+		}
+		if urlPath == "" {
+			http.Redirect(w, r, h.basePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		reqHelper.ctx = context.WithValue(reqHelper.ctx, utils.BasePathKey, h.basePath)
+		reqHelper.r = stripBasePath(reqHelper.r.WithContext(reqHelper.ctx), urlPath)
+	}
+	r = reqHelper.r
+
+	if isCrossSite(r) {
+		reqHelper.log.WarnContext(reqHelper.ctx, "CROSS-SITE REQUEST", "method", r.Method, "origin", r.Header.Get("Origin"), "fetchSite", r.Header.Get("Sec-Fetch-Site"))
+		reqHelper.error("Cross-site requests are not allowed", nil, http.StatusForbidden)
+		return
+	}
+
+	// a share link is its own authorization
+	if urlPath := path.Clean("/" + r.URL.Path); h.shares != nil && strings.HasPrefix(urlPath, sharePath) {
+		h.serveShare(reqHelper)
+		return
+	}
+
+	if h.auth != nil && !h.auth(w, r) {
+		reqHelper.log.InfoContext(reqHelper.ctx, "UNAUTHORIZED", "path", r.URL.Path)
+		return
+	}
+
+	// only clients that know the password or token are asked about
+	if h.approvals != nil && !h.checkApproval(reqHelper, client) {
+		return
+	}
+
+	if urlPath := path.Clean("/" + r.URL.Path); urlPath+"/" == internalPrefix || strings.HasPrefix(urlPath, internalPrefix) {
+		h.serveInternal(reqHelper, urlPath)
+		return
+	}
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", h.allowedMethods())
+		reqHelper.log.InfoContext(reqHelper.ctx, "OPTIONS", "path", r.URL.Path, "allow", h.allowedMethods(), logger.StatusCodeKey, http.StatusNoContent)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if h.upload {
+		switch r.Method {
+		case http.MethodPost:
+			h.handleUpload(reqHelper)
+			return
+		case http.MethodPut:
+			h.handlePut(reqHelper)
+			return
+		}
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", h.allowedMethods())
 		reqHelper.error("Method Not Allowed", nil, http.StatusMethodNotAllowed)
 		return
 	}
 
-	absPath, err := utils.SecureJoin(string(h.root), r.URL.Path)
+	h.serveRead(reqHelper)
+}
 
-	slog.Debug("Secure Join", "path", absPath, "root", string(h.root), "path", r.URL.Path, "error", err)
+// serveRead answers GET and HEAD requests for files and folders.
+func (h handler) serveRead(reqHelper *reqHelper) {
+	w, r := reqHelper.w, reqHelper.r
 
+	name, err := h.readable(r.URL.Path)
 	if errors.Is(err, utils.ErrForbiddenPath) {
 		reqHelper.error("FORBIDDEN", err, http.StatusForbidden)
 		return
@@ -77,42 +162,78 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	info, err := os.Stat(absPath)
+	file, err := h.fsys.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		reqHelper.error("NOT FOUND", err, http.StatusNotFound)
+		return
+	} else if errors.Is(err, utils.ErrForbiddenPath) {
+		reqHelper.error("FORBIDDEN", err, http.StatusForbidden)
+		return
+	} else if err != nil {
+		reqHelper.internalServerError(err)
+		return
+	}
+	defer file.Close()
+
+	// validators must describe the exact file that is sent, so the file is
+	// opened first and then asked about itself
+	info, err := file.Stat()
 	if err != nil {
-		if os.IsNotExist(err) {
-			reqHelper.error("NOT FOUND", err, http.StatusNotFound)
-			return
-		}
 		reqHelper.internalServerError(err)
 		return
 	}
 
-	if info.IsDir() {
-		// check if request is coming from a browser
-		acceptHeader := r.Header.Get("Accept")
-		isBrowser := strings.Contains(acceptHeader, "text/html")
+	// a trailing slash opens an archive like a directory
+	browseArchive := !info.IsDir() && strings.HasSuffix(r.URL.Path, "/") && isBrowsableArchive(name)
 
-		if isBrowser {
-			slog.InfoContext(reqHelper.ctx, "OK - Serving directory with pretty UI", "path", r.URL.Path)
-			h.serveDirectory(w, r, absPath)
+	if info.IsDir() || browseArchive {
+		if archive := r.URL.Query().Get("archive"); archive != "" && !browseArchive {
+			format, err := parseArchiveFormat(archive)
+			if err != nil {
+				reqHelper.error("Unknown archive format", err, http.StatusBadRequest)
+				return
+			}
+			h.serveArchive(reqHelper, format)
+			return
+		}
+
+		// check if request is coming from a browser, http.FileServer would
+		// redirect archives to their download
+		if isBrowser(r) || browseArchive {
+			reqHelper.log.InfoContext(reqHelper.ctx, "OK - Serving directory with pretty UI", "path", r.URL.Path)
+			h.serveDirectory(w, r, name)
 		} else {
-			slog.InfoContext(reqHelper.ctx, "OK - Serving directory default file server", "path", r.URL.Path)
+			reqHelper.log.InfoContext(reqHelper.ctx, "OK - Serving directory default file server", "path", r.URL.Path)
 			h.defaultServer.ServeHTTP(w, r)
 		}
 		return
 	}
 
-	file, err := os.Open(absPath)
+	setValidators(w, info)
+	switch status := checkPreconditions(r, info); status {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		reqHelper.log.InfoContext(reqHelper.ctx, "NOT MODIFIED", "path", r.URL.Path, logger.StatusCodeKey, status)
+		w.WriteHeader(status)
+		return
+	default:
+		reqHelper.error("Precondition Failed", nil, status)
+		return
+	}
+
+	var transferStart = time.Now()
+	fileName := path.Base("/" + name)
+
+	contentType, err := detectContentType(fileName, file)
 	if err != nil {
 		reqHelper.internalServerError(err)
 		return
 	}
-	defer file.Close()
-	var transferStart = time.Now()
 
-	startByte, contentLength, reader, err := reqHelper.handleRange(file, info)
+	body, err := reqHelper.handleRange(file, info, contentType)
 	if err != nil {
 		if errors.Is(err, ErrInvalidRangeHeader) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size()))
 			reqHelper.error("Invalid Range", err, http.StatusRequestedRangeNotSatisfiable)
 			return
 		}
@@ -121,57 +242,136 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Accept-Ranges", "bytes")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", contentLength))
-	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().Unix(), info.Size()))
-
-	fileName := filepath.Base(absPath)
-	var totalSent int64 = 0
-	var totalMBSent float64
-	buf := make([]byte, 1024*1024) // 1MB buffer
-	var lastReportedSent int64 = 0
-	var lastReportedTime = time.Now()
-	reqHelper.publishDownloadStart(fileName, contentLength, startByte, startByte+contentLength-1)
-	for {
-		n, readErr := reader.Read(buf)
-		if readErr != nil {
-			if readErr != io.EOF {
-				slog.ErrorContext(reqHelper.ctx, "Error reading file", "error", readErr, "file", fileName)
-			}
-			break
-		}
+	setContentHeaders(w, fileName, contentType, h.disposition(r))
+	w.Header().Set("Content-Type", body.contentType) // multipart responses name the file type in every part
+	if _, ok := file.(io.Seeker); ok {
+		w.Header().Set("Accept-Ranges", "bytes")
+	} else {
+		w.Header().Set("Accept-Ranges", "none")
+	}
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", body.contentLength))
+	w.WriteHeader(body.statusCode)
 
-		if n > 0 {
-			_, writeErr := w.Write(buf[:n])
-			if writeErr != nil {
-				slog.ErrorContext(reqHelper.ctx, "Error writing response", "error", writeErr, "file", fileName)
-				break
-			}
-			totalSent += int64(n)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	reqHelper.publishDownloadStart(fileName, body.contentLength, body.span.Start, body.span.End)
+
+	pw := newProgressWriter(w, reqHelper, fileName, body.contentLength)
+	if _, err := pw.ReadFrom(body.reader); err != nil {
+		reqHelper.log.ErrorContext(reqHelper.ctx, "Error sending file", "error", err, "file", fileName, "sent", pw.sent)
+		reqHelper.publishDownloadFailed(fileName, pw.sent, err)
+		return
+	}
 
-			reqHelper.publishDownloadProgress(int(totalSent))
+	reqHelper.publishDownloadComplete(fileName, pw.sent, time.Since(transferStart))
+	reqHelper.log.InfoContext(reqHelper.ctx, "TRANSFER COMPLETE", "file", fileName, "totalSent_mb", float64(pw.sent)/1024/1024, "duration", time.Since(transferStart))
+}
 
-			if time.Since(lastReportedTime) > downloadProgressLogInterval {
-				totalMBSent = float64(totalSent) / 1024 / 1024
+// allowedMethods lists the methods accepted for files and folders.
+func (h handler) allowedMethods() string {
+	methods := []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	if h.upload {
+		methods = append(methods, http.MethodPost, http.MethodPut)
+	}
+	return strings.Join(methods, ", ")
+}
+
+// serveInternal dispatches requests in le's reserved URL namespace.
+func (h handler) serveInternal(reqHelper *reqHelper, urlPath string) {
+	if urlPath == zipPath {
+		h.serveSelectionArchive(reqHelper)
+		return
+	}
+
+	if h.upload && strings.HasPrefix(urlPath+"/", tusPath) {
+		h.serveTus(reqHelper, strings.Trim(strings.TrimPrefix(urlPath+"/", tusPath), "/"))
+		return
+	}
 
-				mbps := float64(totalSent-lastReportedSent) / 1024 / 1024 / time.Since(lastReportedTime).Seconds()
+	if h.upload && strings.HasPrefix(urlPath+"/", trashPath) {
+		h.serveTrash(reqHelper, strings.Trim(strings.TrimPrefix(urlPath+"/", trashPath), "/"))
+		return
+	}
 
-				progress := float64(totalSent) / float64(info.Size()) * 100
+	if h.upload && strings.HasPrefix(urlPath, opsPath) {
+		h.serveFileOp(reqHelper, FileOp(strings.TrimPrefix(urlPath, opsPath)))
+		return
+	}
 
-				msg := fmt.Sprintf("%7.2f / %7.2f MB sent | %2.2f%% | %5.2f MB/s",
-					totalMBSent, float64(contentLength)/1024/1024, progress, mbps)
+	reqHelper.error("NOT FOUND", nil, http.StatusNotFound)
+}
 
-				slog.InfoContext(reqHelper.ctx, msg, "file", fileName)
+// resolve maps a URL path onto its name in h.wfs. Paths escaping the root,
+// paths inside le's own state directory and, with HiddenDeny, hidden paths are
+// rejected with utils.ErrForbiddenPath.
+func (h handler) resolve(urlPath string) (string, error) {
+	name := fsName(urlPath)
+
+	if h.root != "" {
+		// symlinks on disk may lead to hidden files under innocent names
+		absPath, err := resolvePath(h.root, urlPath)
+		if err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(h.root, absPath)
+		if err != nil {
+			return "", err
+		}
+		name = fsName(filepath.ToSlash(rel))
+	}
 
-				lastReportedSent = totalSent
-				lastReportedTime = time.Now()
-			}
+	if isStateDir(name) || (h.hidden == HiddenDeny && (hasHiddenSegment(urlPath) || hasHiddenSegment(name))) {
+		return "", utils.ErrForbiddenPath
+	}
+
+	return name, nil
+}
+
+// isHidden reports whether an entry is left out of listings and archives.
+func (h handler) isHidden(name string) bool {
+	return h.hidden != HiddenShow && strings.HasPrefix(name, ".")
+}
 
+func hasHiddenSegment(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if strings.HasPrefix(segment, ".") && segment != "." && segment != ".." {
+			return true
 		}
 	}
+	return false
+}
+
+// url returns the link for a path inside the served directory.
+func (h handler) url(p string) string {
+	return h.basePath + p
+}
+
+// stripBasePath returns a shallow copy of r for urlPath, the request path
+// without the base path.
+func stripBasePath(r *http.Request, urlPath string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = urlPath
+	r2.URL.RawPath = ""
+	return r2
+}
+
+func resolvePath(root, urlPath string) (string, error) {
+	absPath, err := utils.SecureJoin(root, urlPath)
+	if err != nil {
+		return "", err
+	}
 
-	slog.InfoContext(reqHelper.ctx, "TRANSFER COMPLETE", "file", fileName, "totalSent_mb", totalMBSent, "duration", time.Since(transferStart))
+	stateDir := filepath.Join(root, stateDirName)
+	if absPath == stateDir || strings.HasPrefix(absPath, stateDir+string(filepath.Separator)) {
+		return "", utils.ErrForbiddenPath
+	}
+
+	return absPath, nil
 }
 
 type reqHelper struct {
@@ -179,14 +379,29 @@ type reqHelper struct {
 	r   *http.Request
 	ctx context.Context
 	ch  chan<- ServerEvent
+	log *slog.Logger
+
+	// progress not yet published, see publishDownloadProgress
+	pendingSent     int64
+	pendingReceived int64
+	lastProgress    time.Time
 }
 
-func newReqHelper(w http.ResponseWriter, r *http.Request, ch chan<- ServerEvent) *reqHelper {
+func newReqHelper(w http.ResponseWriter, r *http.Request, ch chan<- ServerEvent, log *slog.Logger) *reqHelper {
 	return &reqHelper{
 		w:   w,
 		r:   r,
 		ctx: r.Context(),
 		ch:  ch,
+		log: log,
+	}
+}
+
+// send publishes an event, waiting for the server to take it. Without an
+// event sink events are discarded.
+func (h *reqHelper) send(event ServerEvent) {
+	if h.ch != nil {
+		h.ch <- event
 	}
 }
 
@@ -198,70 +413,130 @@ func (h *reqHelper) attachReqId() *context.Context {
 	return &ctx
 }
 
-func (h *reqHelper) publishNewConn(ip string, host string) {
-	h.ch <- EventConnOpen{
+func (h *reqHelper) publishNewConn(client *Client) {
+	h.send(EventConnOpen{
 		ConnID: h.ctx.Value(utils.RequestIDKey).(string),
-		Client: &Client{
-			IP:          ip,
-			Host:        host,
-			UserAgent:   h.r.UserAgent(),
-			ConnectedAt: time.Now(),
-		},
-	}
+		Client: client,
+		Time:   time.Now(),
+	})
 }
 
 func (h *reqHelper) publishConnClose() {
-	h.ch <- EventConnClose{
+	h.flushProgress()
+	h.send(EventConnClose{
 		ConnID: h.ctx.Value(utils.RequestIDKey).(string),
-	}
+		Time:   time.Now(),
+	})
 }
 
+// progressInterval is the minimum time between two progress events of a
+// request. Progress made in between is coalesced into the next event.
+const progressInterval = 100 * time.Millisecond
+
+// publishDownloadProgress adds sent bytes to the download progress. Unlike
+// the other events progress never blocks the transfer: it is sent at most once
+// per progressInterval and only if the channel has room, otherwise the bytes
+// are carried over to the next event.
 func (h *reqHelper) publishDownloadProgress(sent int) {
-	h.ch <- EventFileProgress{
-		ConnID: h.ctx.Value(utils.RequestIDKey).(string),
-		Sent:   sent,
+	h.pendingSent += int64(sent)
+	if time.Since(h.lastProgress) >= progressInterval {
+		h.flushProgress()
 	}
 }
 
-func (h *reqHelper) publishDownloadStart(fileName string, fileSize int64, rangeStart, rangeEnd int64) {
-	h.ch <- EventDownloadStart{
+func (h *reqHelper) publishDownloadComplete(fileName string, sent int64, duration time.Duration) {
+	h.flushProgress()
+	h.send(EventDownloadComplete{
+		ConnID:   h.ctx.Value(utils.RequestIDKey).(string),
+		FileName: fileName,
+		Bytes:    sent,
+		Duration: duration,
+		Time:     time.Now(),
+	})
+}
+
+func (h *reqHelper) publishDownloadFailed(fileName string, sent int64, err error) {
+	h.flushProgress()
+	h.send(EventDownloadFailed{
+		ConnID:   h.ctx.Value(utils.RequestIDKey).(string),
+		FileName: fileName,
+		Bytes:    sent,
+		Err:      err,
+		Time:     time.Now(),
+	})
+}
+
+func (h *reqHelper) publishUploadStart(fileName string, totalSize int64) {
+	h.pendingReceived = 0
+	h.send(EventUploadStart{
 		ConnID:    h.ctx.Value(utils.RequestIDKey).(string),
 		FileName:  fileName,
+		TotalSize: totalSize,
 		Time:      time.Now(),
-		TotalSize: fileSize,
-		Range:     Range{Start: rangeStart, End: rangeEnd},
+	})
+}
+
+// publishUploadProgress records the number of bytes received so far, it is
+// rate limited like publishDownloadProgress.
+func (h *reqHelper) publishUploadProgress(received int64) {
+	h.pendingReceived = received
+	if time.Since(h.lastProgress) >= progressInterval {
+		h.flushProgress()
 	}
 }
 
-var ErrInvalidRangeHeader = errors.New("invalid range header")
-
-func (h *reqHelper) handleRange(file *os.File, fileInfo os.FileInfo) (startByte int64, contentLength int64, reader io.Reader, err error) {
-	rng := h.r.Header.Get("Range")
-	contentLength = fileInfo.Size()
-	reader = file
-	startByte = 0
-	if rng != "" {
-		startByte, endByte, parseErr := utils.ParseRangeHeader(rng, fileInfo.Size())
-		if parseErr != nil {
-			return 0, 0, nil, ErrInvalidRangeHeader
+// flushProgress tries to publish pending progress without blocking.
+func (h *reqHelper) flushProgress() {
+	connID := h.ctx.Value(utils.RequestIDKey).(string)
+	now := time.Now()
+
+	if h.pendingSent > 0 {
+		select {
+		case h.ch <- EventFileProgress{ConnID: connID, Sent: int(h.pendingSent), Time: now}:
+			h.pendingSent = 0
+			h.lastProgress = now
+		default:
 		}
+	}
 
-		if _, err := file.Seek(startByte, io.SeekStart); err != nil {
-			return 0, 0, nil, err
+	if h.pendingReceived > 0 {
+		select {
+		case h.ch <- EventUploadProgress{ConnID: connID, Received: h.pendingReceived, Time: now}:
+			h.pendingReceived = 0
+			h.lastProgress = now
+		default:
 		}
+	}
+}
 
-		contentLength = endByte - startByte + 1
-		reader = io.LimitReader(file, contentLength)
-
-		h.w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", startByte, endByte, fileInfo.Size()))
-		h.w.WriteHeader(http.StatusPartialContent)
+func (h *reqHelper) publishUploadComplete(fileName string, size int64) {
+	h.flushProgress()
+	h.send(EventUploadComplete{
+		ConnID:   h.ctx.Value(utils.RequestIDKey).(string),
+		FileName: fileName,
+		Size:     size,
+		Time:     time.Now(),
+	})
+}
 
-		slog.InfoContext(h.ctx, "PARTIAL", "path", h.r.URL.Path, "start", startByte, "end", endByte, "total", contentLength, logger.StatusCodeKey, http.StatusPartialContent)
-	} else {
-		slog.InfoContext(h.ctx, "OK", "path", h.r.URL.Path, "size", contentLength, logger.StatusCodeKey, http.StatusOK)
-	}
+func (h *reqHelper) publishFileOp(op FileOp, path, target string) {
+	h.send(EventFileOp{
+		ConnID: h.ctx.Value(utils.RequestIDKey).(string),
+		Op:     op,
+		Path:   path,
+		Target: target,
+		Time:   time.Now(),
+	})
+}
 
-	return startByte, contentLength, reader, nil
+func (h *reqHelper) publishDownloadStart(fileName string, fileSize int64, rangeStart, rangeEnd int64) {
+	h.send(EventDownloadStart{
+		ConnID:    h.ctx.Value(utils.RequestIDKey).(string),
+		FileName:  fileName,
+		Time:      time.Now(),
+		TotalSize: fileSize,
+		Range:     Range{Start: rangeStart, End: rangeEnd},
+	})
 }
 
 func (h *reqHelper) internalServerError(err error) {
@@ -270,5 +545,35 @@ func (h *reqHelper) internalServerError(err error) {
 
 func (h *reqHelper) error(mgs string, err error, statusCode int) {
 	http.Error(h.w, mgs, statusCode)
-	slog.ErrorContext(h.ctx, "", logger.StatusCodeKey, statusCode, "error", err)
+	h.log.ErrorContext(h.ctx, "", logger.StatusCodeKey, statusCode, "error", err)
+
+	h.send(EventError{
+		ConnID:     h.ctx.Value(utils.RequestIDKey).(string),
+		StatusCode: statusCode,
+		Message:    mgs,
+		Err:        err,
+		Time:       time.Now(),
+	})
+}
+
+// isCrossSite reports whether r would change something on behalf of another
+// site, e.g. a page that posts a form to /.le/fs/delete. Browsers say where a
+// request comes from, scripts and curl send neither header and are let
+// through.
+func isCrossSite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+
+	if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || !strings.EqualFold(u.Host, r.Host)
 }
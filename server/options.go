@@ -0,0 +1,253 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	"go.sakib.dev/le/pkg/utils"
+)
+
+// HiddenPolicy decides how files and folders whose name starts with a dot are
+// treated.
+type HiddenPolicy string
+
+const (
+	// HiddenHide leaves hidden entries out of listings and archives, they can
+	// still be downloaded by URL.
+	HiddenHide HiddenPolicy = "hide"
+	// HiddenShow treats hidden entries like any other.
+	HiddenShow HiddenPolicy = "show"
+	// HiddenDeny hides them and refuses every request for them.
+	HiddenDeny HiddenPolicy = "deny"
+)
+
+func ParseHiddenPolicy(s string) (HiddenPolicy, error) {
+	switch HiddenPolicy(s) {
+	case HiddenHide, HiddenShow, HiddenDeny:
+		return HiddenPolicy(s), nil
+	}
+	return "", fmt.Errorf("invalid hidden file policy %q, must be %q, %q or %q", s, HiddenHide, HiddenShow, HiddenDeny)
+}
+
+// hidingFileSystem leaves hidden entries out of the plain listings of
+// http.FileServer.
+type hidingFileSystem struct {
+	http.FileSystem
+	hide func(name string) bool
+}
+
+func (fsys hidingFileSystem) Open(name string) (http.File, error) {
+	f, err := fsys.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return hidingFile{File: f, hide: fsys.hide}, nil
+}
+
+type hidingFile struct {
+	http.File
+	hide func(name string) bool
+}
+
+func (f hidingFile) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+
+	visible := infos[:0]
+	for _, info := range infos {
+		if !f.hide(info.Name()) {
+			visible = append(visible, info)
+		}
+	}
+
+	return visible, err
+}
+
+// AuthFunc reports whether a request may proceed. When it returns false it
+// must have written a response, e.g. a 401 with a WWW-Authenticate challenge.
+type AuthFunc func(w http.ResponseWriter, r *http.Request) bool
+
+// Option configures the handler returned by NewHandler.
+type Option func(*options)
+
+type options struct {
+	root        string
+	fsys        fs.FS
+	upload      bool
+	disposition Disposition
+	hidden      HiddenPolicy
+	trash       *Trash
+	auth        AuthFunc
+	policy      *IPPolicy
+	approvals   *Approvals
+	shares      *Shares
+	logger      *slog.Logger
+	events      chan<- ServerEvent
+	basePath    string
+}
+
+// WithRoot sets the directory to serve, the default is the working directory.
+func WithRoot(dir string) Option {
+	return func(o *options) { o.root, o.fsys = dir, nil }
+}
+
+// WithFS serves fsys instead of a directory. Uploads and file management need
+// a WritableFS, the trash needs one returned by DirFS.
+func WithFS(fsys fs.FS) Option {
+	return func(o *options) { o.fsys = fsys }
+}
+
+// WithUpload allows clients to upload files and manage the served directory.
+func WithUpload(enabled bool) Option {
+	return func(o *options) { o.upload = enabled }
+}
+
+// WithDisposition sets whether browsers show files or save them by default.
+func WithDisposition(d Disposition) Option {
+	return func(o *options) { o.disposition = d }
+}
+
+// WithHiddenFiles sets the policy for dot files, the default is HiddenHide.
+func WithHiddenFiles(p HiddenPolicy) Option {
+	return func(o *options) { o.hidden = p }
+}
+
+// WithTrash keeps deleted and overwritten files in t. Without a trash they
+// are removed permanently.
+func WithTrash(t *Trash) Option {
+	return func(o *options) { o.trash = t }
+}
+
+// WithAuth runs fn before every request.
+func WithAuth(fn AuthFunc) Option {
+	return func(o *options) { o.auth = fn }
+}
+
+// WithIPPolicy turns away clients whose IP p rejects with 403 Forbidden,
+// before anything else is done for them.
+func WithIPPolicy(p *IPPolicy) Option {
+	return func(o *options) { o.policy = p }
+}
+
+// WithApprovals holds clients seen for the first time until they are
+// approved in a, see Approvals.
+func WithApprovals(a *Approvals) Option {
+	return func(o *options) { o.approvals = a }
+}
+
+// WithShares serves the share links minted by s below /.le/share/, see
+// Shares.
+func WithShares(s *Shares) Option {
+	return func(o *options) { o.shares = s }
+}
+
+// WithLogger sets the logger for requests and transfers, the default is
+// slog.Default().
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) { o.logger = l }
+}
+
+// WithEventSink makes the handler publish ServerEvents on ch. The handler
+// waits for ch to take connection and transfer events, while ch is full
+// progress is coalesced into later events. Without a sink events are
+// discarded.
+func WithEventSink(ch chan<- ServerEvent) Option {
+	return func(o *options) { o.events = ch }
+}
+
+// WithBasePath mounts the handler below prefix, e.g. "/files". Requests must
+// carry the prefix and every link the handler generates includes it.
+func WithBasePath(prefix string) Option {
+	return func(o *options) { o.basePath = prefix }
+}
+
+// NewHandler returns le's file server as an http.Handler, ready to be mounted
+// in any HTTP server. It has no global side effects.
+func NewHandler(opts ...Option) (http.Handler, error) {
+	o := options{
+		root:        ".",
+		disposition: DispositionInline,
+		hidden:      HiddenHide,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	fsys := o.fsys
+	if fsys == nil {
+		dir, err := utils.ValidAbsDir(o.root)
+		if err != nil {
+			return nil, fmt.Errorf("invalid directory: %w", err)
+		}
+		fsys = DirFS(dir)
+	}
+
+	wfs, ok := fsys.(WritableFS)
+	if !ok && o.upload {
+		return nil, fmt.Errorf("upload: %w", ErrReadOnlyFS)
+	}
+
+	// the trash lives outside the served tree and moves entries on disk
+	dir := ""
+	if d, ok := fsys.(dirFS); ok {
+		dir = string(d)
+	} else if o.trash != nil {
+		return nil, fmt.Errorf("trash: %w", ErrNotOSDir)
+	}
+
+	if _, err := ParseDisposition(string(o.disposition)); err != nil {
+		return nil, err
+	}
+	if _, err := ParseHiddenPolicy(string(o.hidden)); err != nil {
+		return nil, err
+	}
+
+	basePath := ""
+	if o.basePath != "" {
+		basePath = strings.TrimSuffix(path.Clean("/"+o.basePath), "/")
+	}
+
+	logger := o.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	h := &handler{
+		root:               dir,
+		fsys:               archiveFS{fsys},
+		wfs:                wfs,
+		upload:             o.upload,
+		defaultDisposition: o.disposition,
+		hidden:             o.hidden,
+		basePath:           basePath,
+		auth:               o.auth,
+		policy:             o.policy,
+		approvals:          o.approvals,
+		shares:             o.shares,
+		trash:              o.trash,
+		log:                logger,
+		ch:                 o.events,
+	}
+
+	if wfs != nil {
+		h.tus = newTusStore(wfs)
+	}
+
+	h.defaultServer = newDefaultServer(h)
+
+	return h, nil
+}
+
+// newDefaultServer returns the plain file server for h.fsys, it lists folders
+// for clients other than browsers.
+func newDefaultServer(h *handler) http.Handler {
+	return http.FileServer(hidingFileSystem{
+		FileSystem: http.FS(h.fsys),
+		hide: func(name string) bool {
+			return h.isHidden(name) || name == stateDirName
+		},
+	})
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.sakib.dev/le/logger"
+)
+
+// DefaultAllowedNetworks are the networks a Server lets in by default: the
+// private (RFC 1918 and unique local), link-local and loopback ranges.
+var DefaultAllowedNetworks = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"127.0.0.0/8",
+	"fc00::/7",
+	"fe80::/10",
+	"::1/128",
+}
+
+var (
+	ErrInvalidIP  = errors.New("invalid IP address")
+	ErrNoIPPolicy = errors.New("no IP policy")
+)
+
+// IPPolicy decides by client IP who may talk to the handler at all, before
+// approvals, auth or any path is looked at. An IP is rejected if it is
+// banned or in a denied network, otherwise it is let in if it is in an
+// allowed network. Without allowed networks every IP that isn't denied is
+// let in.
+type IPPolicy struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+
+	mu     sync.Mutex
+	banned map[netip.Addr]struct{}
+}
+
+// NewIPPolicy returns a policy for the allowed and denied networks, given in
+// CIDR notation or as single IPs.
+func NewIPPolicy(allow, deny []string) (*IPPolicy, error) {
+	p := &IPPolicy{banned: make(map[netip.Addr]struct{})}
+
+	var err error
+	if p.allow, err = parseNetworks(allow); err != nil {
+		return nil, err
+	}
+	if p.deny, err = parseNetworks(deny); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// DefaultIPPolicy returns a policy that allows DefaultAllowedNetworks.
+func DefaultIPPolicy() *IPPolicy {
+	p, err := NewIPPolicy(DefaultAllowedNetworks, nil)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func parseNetworks(networks []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(networks))
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			addr, err := parseAddr(network)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q: %w", network, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", network, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// parseAddr parses ip the way it is matched, IPv4 addresses mapped to IPv6
+// are treated as IPv4 and zones are ignored.
+func parseAddr(ip string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Addr{}, ErrInvalidIP
+	}
+	return addr.Unmap().WithZone(""), nil
+}
+
+// check returns why ip is rejected, or "" if it may go on.
+func (p *IPPolicy) check(ip string) string {
+	addr, err := parseAddr(ip)
+	if err != nil {
+		return "unknown address"
+	}
+
+	p.mu.Lock()
+	_, banned := p.banned[addr]
+	p.mu.Unlock()
+
+	contains := func(prefix netip.Prefix) bool { return prefix.Contains(addr) }
+	switch {
+	case banned:
+		return "banned"
+	case slices.ContainsFunc(p.deny, contains):
+		return "denied network"
+	case len(p.allow) > 0 && !slices.ContainsFunc(p.allow, contains):
+		return "network not allowed"
+	}
+	return ""
+}
+
+// Allowed reports whether ip may talk to the handler.
+func (p *IPPolicy) Allowed(ip string) bool {
+	return p.check(ip) == ""
+}
+
+// Ban rejects ip from now on, whatever networks are allowed.
+func (p *IPPolicy) Ban(ip string) error {
+	addr, err := parseAddr(ip)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.banned[addr] = struct{}{}
+	return nil
+}
+
+// Unban lifts the ban of ip.
+func (p *IPPolicy) Unban(ip string) error {
+	addr, err := parseAddr(ip)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.banned, addr)
+	return nil
+}
+
+// Banned returns the banned IPs in order.
+func (p *IPPolicy) Banned() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	addrs := make([]netip.Addr, 0, len(p.banned))
+	for addr := range p.banned {
+		addrs = append(addrs, addr)
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+
+	banned := make([]string, len(addrs))
+	for i, addr := range addrs {
+		banned[i] = addr.String()
+	}
+	return banned
+}
+
+// checkPolicy reports whether the client may go on, otherwise it answered
+// with 403 Forbidden.
+func (h handler) checkPolicy(reqHelper *reqHelper, clientIP string) bool {
+	reason := h.policy.check(clientIP)
+	if reason == "" {
+		return true
+	}
+
+	reqHelper.log.WarnContext(reqHelper.ctx, "REJECTED", "clientIP", clientIP, "reason", reason, "path", reqHelper.r.URL.Path, logger.StatusCodeKey, http.StatusForbidden)
+	http.Error(reqHelper.w, "Forbidden", http.StatusForbidden)
+	return false
+}
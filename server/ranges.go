@@ -0,0 +1,121 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"go.sakib.dev/le/logger"
+	"go.sakib.dev/le/pkg/utils"
+)
+
+// maxRanges limits how many ranges a single request may ask for. Download
+// accelerators use a handful, anything beyond this is most likely abuse.
+const maxRanges = 32
+
+var ErrInvalidRangeHeader = errors.New("invalid range header")
+
+// fileBody is what gets sent for a file download: the whole file, a single
+// range of it or a multipart/byteranges body with several ranges.
+type fileBody struct {
+	statusCode    int
+	contentType   string
+	contentLength int64
+	span          utils.ByteRange // first to last byte of the file that is sent
+	reader        io.Reader
+}
+
+// handleRange prepares the response body according to the Range header and sets
+// Content-Range for single range responses. contentType is the type of file.
+// Files that can't seek are always sent whole.
+func (h *reqHelper) handleRange(file fs.File, fileInfo fs.FileInfo, contentType string) (fileBody, error) {
+	size := fileInfo.Size()
+	body := fileBody{
+		statusCode:    http.StatusOK,
+		contentType:   contentType,
+		contentLength: size,
+		span:          utils.ByteRange{Start: 0, End: size - 1},
+		reader:        file,
+	}
+
+	rng := h.r.Header.Get("Range")
+	if rng != "" && !ifRangeMatches(h.r, fileInfo) {
+		// the client holds a different version, send it the whole file
+		h.log.InfoContext(h.ctx, "RANGE IGNORED", "path", h.r.URL.Path, "ifRange", h.r.Header.Get("If-Range"))
+		rng = ""
+	}
+
+	seeker, seekable := file.(io.ReadSeeker)
+	if rng != "" && !seekable {
+		h.log.InfoContext(h.ctx, "RANGE IGNORED", "path", h.r.URL.Path, "reason", "file is not seekable")
+		rng = ""
+	}
+
+	if rng == "" {
+		h.log.InfoContext(h.ctx, "OK", "path", h.r.URL.Path, "size", size, logger.StatusCodeKey, http.StatusOK)
+		return body, nil
+	}
+
+	ranges, err := utils.ParseRanges(rng, size, maxRanges)
+	if err != nil {
+		return fileBody{}, fmt.Errorf("%w: %w", ErrInvalidRangeHeader, err)
+	}
+
+	body.statusCode = http.StatusPartialContent
+	body.span = utils.ByteRange{Start: ranges[0].Start, End: ranges[len(ranges)-1].End}
+
+	if len(ranges) == 1 {
+		// a LimitedReader around the file keeps the sendfile path open
+		if _, err := seeker.Seek(ranges[0].Start, io.SeekStart); err != nil {
+			return fileBody{}, err
+		}
+		body.contentLength = ranges[0].Length()
+		body.reader = io.LimitReader(file, ranges[0].Length())
+
+		h.w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", ranges[0].Start, ranges[0].End, size))
+
+		h.log.InfoContext(h.ctx, "PARTIAL", "path", h.r.URL.Path, "start", ranges[0].Start, "end", ranges[0].End, "total", body.contentLength, logger.StatusCodeKey, http.StatusPartialContent)
+		return body, nil
+	}
+
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	body.contentType = "multipart/byteranges; boundary=" + boundary
+	readerAt, ok := file.(io.ReaderAt)
+	if !ok {
+		readerAt = seekReaderAt{seeker}
+	}
+	body.reader, body.contentLength = multipartBody(readerAt, size, contentType, boundary, ranges)
+
+	h.log.InfoContext(h.ctx, "PARTIAL", "path", h.r.URL.Path, "ranges", len(ranges), "total", body.contentLength, logger.StatusCodeKey, http.StatusPartialContent)
+	return body, nil
+}
+
+// multipartBody returns a multipart/byteranges body holding ranges of file,
+// along with its exact length so it can be sent with a Content-Length.
+func multipartBody(file io.ReaderAt, size int64, contentType, boundary string, ranges []utils.ByteRange) (io.Reader, int64) {
+	var readers []io.Reader
+	var length int64
+
+	for i, rng := range ranges {
+		var header strings.Builder
+		if i > 0 {
+			header.WriteString("\r\n")
+		}
+		fmt.Fprintf(&header, "--%s\r\n", boundary)
+		fmt.Fprintf(&header, "Content-Type: %s\r\n", contentType)
+		fmt.Fprintf(&header, "Content-Range: bytes %d-%d/%d\r\n\r\n", rng.Start, rng.End, size)
+
+		readers = append(readers, strings.NewReader(header.String()), io.NewSectionReader(file, rng.Start, rng.Length()))
+		length += int64(header.Len()) + rng.Length()
+	}
+
+	trailer := fmt.Sprintf("\r\n--%s--\r\n", boundary)
+	readers = append(readers, strings.NewReader(trailer))
+	length += int64(len(trailer))
+
+	return io.MultiReader(readers...), length
+}
@@ -1,21 +1,58 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"log/slog"
+	"net"
 	"net/http"
+	"syscall"
 
-	"go.sakib.dev/le/logger"
 	"go.sakib.dev/le/pkg/utils"
 )
 
+const maxActivity = 10
+
 type Server struct {
-	Dir     string
-	Port    int
-	state   ServerState
-	eventCh chan ServerEventName
+	Dir             string
+	Port            int
+	Upload          bool
+	Disposition     Disposition
+	TrashRetention  time.Duration
+	Hidden          HiddenPolicy
+	PortFallback    bool         // try the next ports when Port is taken
+	Password        string       // require this password with HTTP Basic auth
+	Token           string       // require this access token, see NewToken
+	RequireApproval bool         // hold new clients until they are approved, see Approve
+	Policy          *IPPolicy    // who may connect at all, nil lets everyone in
+	TLS             bool         // serve HTTPS, with a self-signed certificate unless TLSCert is set
+	TLSCert         string       // PEM certificate file, used with TLSKey
+	TLSKey          string       // PEM key file
+	Logger          *slog.Logger // defaults to slog.Default()
+	state           ServerState
+	stateMu         sync.RWMutex // guards state, which is read by the UI while requests update it
+	trash           *Trash       // set once serving, guarded by stateMu
+	approvals       *Approvals   // always set, the UI polls it before serving starts
+	shares          *Shares      // always set, writes nothing before the first link
+	baseURL         string       // without the access token, guarded by stateMu
+	eventCh         chan ServerEventName
+	droppedEvents   atomic.Int64
+	subs            map[*subscriber]struct{}
+	subsMu          sync.Mutex
+	listener        net.Listener
+	tlsConfig       *tls.Config
+	handler         http.Handler
+	httpServer      atomic.Pointer[http.Server]
+	netConns        map[net.Conn]struct{} // open connections, so a ban can cut them off
+	netConnsMu      sync.Mutex
+	done            chan struct{} // closed by Shutdown and Close, stops background work
+	stopOnce        sync.Once
 }
 
 func NewServer(dir string, port int, ch chan ServerEventName) (*Server, error) {
@@ -24,14 +61,17 @@ func NewServer(dir string, port int, ch chan ServerEventName) (*Server, error) {
 		return nil, fmt.Errorf("invalid directory: %w", err)
 	}
 
-	slog.SetDefault(slog.New(logger.NewHandler()))
-
-	slog.Info("Got directory:", "dir", dir)
-
 	return &Server{
-		Dir:     dir,
-		Port:    port,
-		eventCh: ch,
+		Dir:            dir,
+		Port:           port,
+		Disposition:    DispositionInline,
+		Hidden:         HiddenHide,
+		TrashRetention: DefaultTrashRetention,
+		Policy:         DefaultIPPolicy(),
+		approvals:      NewApprovals(),
+		shares:         NewShares(dir),
+		done:           make(chan struct{}),
+		eventCh:        ch,
 		state: ServerState{
 			Dir:   utils.ReplaceHome(dir),
 			Conns: make(map[string]*Conn),
@@ -39,48 +79,269 @@ func NewServer(dir string, port int, ch chan ServerEventName) (*Server, error) {
 	}, nil
 }
 
+// portFallbackAttempts is how many of the following ports are tried when the
+// port is taken and PortFallback is set.
+const portFallbackAttempts = 10
+
+// Start listens on the port and serves until the server is shut down.
 func (s *Server) Start() error {
-	ch := make(chan ServerEvent, 100)
-	handler := newHandler(s.Dir, ch)
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Listen binds the port, so errors such as a port that is already taken show
+// up before anything is served. Port 0 picks any free port. Port is updated
+// to the port actually used and so is the address in the state. Listen may be
+// called again after an error, e.g. with another port.
+func (s *Server) Listen() error {
+	if s.TLS && s.tlsConfig == nil {
+		if err := s.loadCertificate(); err != nil {
+			return err
+		}
+	}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Port))
+	if err != nil && s.PortFallback && s.Port != 0 && errors.Is(err, syscall.EADDRINUSE) {
+		for port := s.Port + 1; port <= min(s.Port+portFallbackAttempts, 65535); port++ {
+			var ferr error
+			if l, ferr = net.Listen("tcp", fmt.Sprintf(":%d", port)); ferr == nil {
+				s.logger().Warn("Port is taken, using the next free one", "port", s.Port, "next", port)
+				err = nil
+				break
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error starting server: %w", err)
+	}
 
+	s.Port = l.Addr().(*net.TCPAddr).Port
+	if s.tlsConfig != nil {
+		l = tls.NewListener(l, s.tlsConfig)
+	}
+	s.listener = l
 	s.PrintUrl()
 
-	go s.listenForData(ch)
+	return nil
+}
+
+// loadCertificate loads TLSCert and TLSKey, or the self-signed certificate
+// without them.
+func (s *Server) loadCertificate() error {
+	var cert tls.Certificate
+	var err error
+	if s.TLSCert != "" || s.TLSKey != "" {
+		cert, err = LoadCertificate(s.TLSCert, s.TLSKey)
+	} else {
+		cert, err = SelfSignedCertificate()
+	}
+	if err != nil {
+		return err
+	}
 
-	addr := fmt.Sprintf(":%d", s.Port)
-	err := http.ListenAndServe(addr, handler)
+	s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 
+	s.stateMu.Lock()
+	s.state.Fingerprint = Fingerprint(cert)
+	s.stateMu.Unlock()
+
+	return nil
+}
+
+// Serve serves on the listener opened by Listen until the server is shut
+// down, which isn't an error.
+func (s *Server) Serve() error {
+	if s.listener == nil {
+		return errors.New("error starting server: not listening")
+	}
+
+	if s.handler == nil {
+		if err := s.setup(); err != nil {
+			return err
+		}
+	}
+
+	srv := &http.Server{Handler: s.handler, ConnState: s.trackConn}
+	s.httpServer.Store(srv)
+
+	err := srv.Serve(s.listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("error serving files: %w", err)
+	}
+
+	return nil
+}
+
+// setup creates the trash and the handler, it runs once however often Serve
+// is retried.
+func (s *Server) setup() error {
+	ch := make(chan ServerEvent, 100)
+
+	// the UI reads the trash from the start, it is only published once complete
+	var trash *Trash
+	if s.Upload {
+		var err error
+		if trash, err = NewTrash(s.Dir, s.TrashRetention); err != nil {
+			return err
+		}
+		go s.purgeTrash(trash)
+	}
+
+	opts := []Option{
+		WithRoot(s.Dir),
+		WithUpload(s.Upload),
+		WithDisposition(s.Disposition),
+		WithHiddenFiles(s.Hidden),
+		WithLogger(s.logger()),
+		WithEventSink(ch),
+		WithShares(s.shares),
+	}
+	if trash != nil {
+		opts = append(opts, WithTrash(trash))
+	}
+	if s.Policy != nil {
+		opts = append(opts, WithIPPolicy(s.Policy))
+	}
+	if s.RequireApproval {
+		opts = append(opts, WithApprovals(s.approvals))
+	}
+	if s.Password != "" || s.Token != "" {
+		opts = append(opts, WithAuth(NewAccessControl(s.Password, s.Token).Check))
+	}
+
+	handler, err := NewHandler(opts...)
 	if err != nil {
-		return fmt.Errorf("error starting server: %w", err)
+		return err
 	}
+	s.handler = handler
+
+	s.stateMu.Lock()
+	s.trash = trash
+	s.state.Upload = s.Upload
+	s.stateMu.Unlock()
+
+	go s.listenForData(ch)
 
 	return nil
 }
 
+// Shutdown stops accepting connections right away and waits for the active
+// transfers to finish. If ctx is done first its error is returned and the
+// remaining transfers go on until Close is called.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stop()
+
+	s.stateMu.Lock()
+	s.state.ShuttingDown = true
+	s.stateMu.Unlock()
+	s.publish(EvNameShutdown)
+
+	srv := s.httpServer.Load()
+	if srv == nil {
+		return nil
+	}
+
+	s.logger().Info("Shutting down, waiting for active transfers")
+	return srv.Shutdown(ctx)
+}
+
+// Close stops the server immediately, cutting off active transfers.
+func (s *Server) Close() error {
+	s.stop()
+
+	srv := s.httpServer.Load()
+	if srv == nil {
+		return nil
+	}
+	return srv.Close()
+}
+
+// stop ends the background work of the server, it may be called repeatedly.
+func (s *Server) stop() {
+	s.stopOnce.Do(func() { close(s.done) })
+}
+
 func (s *Server) PrintUrl() {
 	localIP, err := utils.GetLocalIP()
 	if err != nil {
-		slog.Error("Error getting local IP", "error", err)
+		s.logger().Error("Error getting local IP", "error", err)
 		localIP = "localhost"
 	}
 
-	url := fmt.Sprintf("http://%s:%d", localIP, s.Port)
-	slog.Info("Serving files from", "directory", s.Dir)
-	slog.Info("File server is running on", "url", url)
+	scheme := "http"
+	if s.tlsConfig != nil {
+		scheme = "https"
+	}
+
+	url := fmt.Sprintf("%s://%s:%d", scheme, localIP, s.Port)
+	s.logger().Info("Serving files from", "directory", s.Dir)
+	s.logger().Info("File server is running on", "url", url)
 
+	// whoever scans the QR code is let in, the token stays out of the log
+	base := url
+	if s.Token != "" {
+		url += "/?" + tokenParam + "=" + s.Token
+	}
+
+	// the fragment never reaches the server, it is there to compare with
+	// the certificate the browser is shown
+	if s.tlsConfig != nil {
+		cert := s.tlsConfig.Certificates[0]
+		s.logger().Info("Certificate", "sha256", Fingerprint(cert))
+		if s.Token == "" {
+			url += "/"
+		}
+		url += "#fp=" + ShortFingerprint(cert)
+	}
+
+	s.stateMu.Lock()
+	s.baseURL = base
 	s.state.Addr = &url
+	s.stateMu.Unlock()
+
 	s.publish(EvNameAddrUpdated)
 
 }
 
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// publish notifies the UI that the state changed. The UI reads the whole state
+// on every notification, so when it lags behind notifications are dropped
+// rather than holding up the server and with it every transfer.
 func (s *Server) publish(event ServerEventName) {
-	if s.eventCh != nil {
-		s.eventCh <- event
+	if s.eventCh == nil {
+		return
 	}
+
+	select {
+	case s.eventCh <- event:
+	default:
+		dropped := s.droppedEvents.Add(1)
+		s.logger().Debug("Dropped server event, subscriber is lagging", "event", event, "dropped", dropped)
+	}
+}
+
+// DroppedEvents returns how many notifications were dropped because the
+// subscriber wasn't keeping up.
+func (s *Server) DroppedEvents() int64 {
+	return s.droppedEvents.Load()
 }
 
+// GetState returns a snapshot of the current state. It is a deep copy, so the
+// caller may keep and read it while the server goes on changing its state.
 func (s *Server) GetState() *ServerState {
-	return &s.state
+	s.stateMu.RLock()
+	defer s.stateMu.RUnlock()
+
+	state := s.state.clone()
+	return &state
 }
 
 func (s *Server) listenForData(ch <-chan ServerEvent) {
@@ -94,13 +355,30 @@ func (s *Server) listenForData(ch <-chan ServerEvent) {
 			s.handleDownloadProgress(data)
 		case EventDownloadStart:
 			s.handleDownloadStart(data)
+		case EventUploadStart:
+			s.handleUploadStart(data)
+		case EventUploadProgress:
+			s.handleUploadProgress(data)
+		case EventUploadComplete:
+			s.handleUploadComplete(data)
+		case EventFileOp:
+			s.handleFileOp(data)
+		case EventApprovalRequest:
+			s.publish(EvNameApprovalRequest)
+		case EventDownloadComplete, EventDownloadFailed, EventError:
+			// only of interest to subscribers
 		default:
-			slog.Warn("Unknown server event", "event", data)
+			s.logger().Warn("Unknown server event", "event", data)
 		}
+
+		s.broadcast(data)
 	}
 }
 
 func (s *Server) handleConnOpen(event EventConnOpen) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+
 	s.state.Conns[event.ConnID] = &Conn{
 		ID:        event.ConnID,
 		Client:    event.Client,
@@ -111,18 +389,24 @@ func (s *Server) handleConnOpen(event EventConnOpen) {
 }
 
 func (s *Server) handleConnClose(event EventConnClose) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+
 	if _, exists := s.state.Conns[event.ConnID]; exists {
 		delete(s.state.Conns, event.ConnID)
 		s.publish(EvNameConnClose)
 	} else {
-		slog.Warn("Connection close event for unknown connection", "conn_id", event.ConnID)
+		s.logger().Warn("Connection close event for unknown connection", "conn_id", event.ConnID)
 	}
 }
 
 func (s *Server) handleDownloadStart(event EventDownloadStart) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+
 	conn, exists := s.state.Conns[event.ConnID]
 	if !exists {
-		slog.Warn("Download start event for unknown connection", "conn_id", event.ConnID)
+		s.logger().Warn("Download start event for unknown connection", "conn_id", event.ConnID)
 		return
 	}
 
@@ -134,9 +418,12 @@ func (s *Server) handleDownloadStart(event EventDownloadStart) {
 }
 
 func (s *Server) handleDownloadProgress(event EventFileProgress) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+
 	conn, exists := s.state.Conns[event.ConnID]
 	if !exists {
-		slog.Warn("File progress event for unknown connection", "conn_id", event.ConnID)
+		s.logger().Warn("File progress event for unknown connection", "conn_id", event.ConnID)
 		return
 	}
 
@@ -145,3 +432,342 @@ func (s *Server) handleDownloadProgress(event EventFileProgress) {
 	conn.UpdatedAt = event.Time
 	s.publish(EvNameFileProgress)
 }
+
+func (s *Server) handleUploadStart(event EventUploadStart) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+
+	conn, exists := s.state.Conns[event.ConnID]
+	if !exists {
+		s.logger().Warn("Upload start event for unknown connection", "conn_id", event.ConnID)
+		return
+	}
+
+	conn.Filename = event.FileName
+	conn.TotalReceived = 0
+	conn.UpdatedAt = event.Time
+
+	s.publish(EvNameUploadStart)
+}
+
+func (s *Server) handleUploadProgress(event EventUploadProgress) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+
+	conn, exists := s.state.Conns[event.ConnID]
+	if !exists {
+		s.logger().Warn("Upload progress event for unknown connection", "conn_id", event.ConnID)
+		return
+	}
+
+	received := event.Received - conn.TotalReceived
+	conn.TotalReceived = event.Received
+	conn.CurSpeed = int64(float64(received) / time.Since(conn.UpdatedAt).Seconds())
+	conn.UpdatedAt = event.Time
+	s.publish(EvNameUploadProgress)
+}
+
+func (s *Server) handleUploadComplete(event EventUploadComplete) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+
+	client := "unknown"
+	if conn, exists := s.state.Conns[event.ConnID]; exists {
+		client = conn.Client.Host
+	}
+
+	s.addActivity(Activity{
+		Time:    event.Time,
+		Client:  client,
+		Message: fmt.Sprintf("uploaded %s (%d bytes)", event.FileName, event.Size),
+	})
+
+	s.publish(EvNameUploadComplete)
+}
+
+func (s *Server) handleFileOp(event EventFileOp) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+
+	client := "unknown"
+	if conn, exists := s.state.Conns[event.ConnID]; exists {
+		client = conn.Client.Host
+	}
+
+	var msg string
+	switch event.Op {
+	case FileOpMkdir:
+		msg = fmt.Sprintf("created folder %s", event.Target)
+	case FileOpDelete:
+		msg = fmt.Sprintf("deleted %s", event.Path)
+	default:
+		msg = fmt.Sprintf("%sd %s to %s", event.Op, event.Path, event.Target)
+	}
+
+	s.addActivity(Activity{
+		Time:    event.Time,
+		Client:  client,
+		Message: msg,
+	})
+
+	s.publish(EvNameFileOp)
+}
+
+// addActivity appends to the activity feed, keeping only the latest entries.
+// The caller must hold stateMu.
+func (s *Server) addActivity(a Activity) {
+	s.state.Activity = append(s.state.Activity, a)
+	if len(s.state.Activity) > maxActivity {
+		s.state.Activity = s.state.Activity[len(s.state.Activity)-maxActivity:]
+	}
+}
+
+// purgeTrash periodically removes trash entries past the retention period.
+func (s *Server) purgeTrash(trash *Trash) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := trash.Purge(); err != nil {
+			s.logger().Error("Error purging trash", "error", err)
+		} else if n > 0 {
+			s.logger().Info("Purged trash", "entries", n)
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// TrashEntries lists the trash, it is empty unless uploads are enabled.
+func (s *Server) TrashEntries() ([]TrashEntry, error) {
+	trash := s.getTrash()
+	if trash == nil {
+		return nil, nil
+	}
+	return trash.List()
+}
+
+func (s *Server) getTrash() *Trash {
+	s.stateMu.RLock()
+	defer s.stateMu.RUnlock()
+	return s.trash
+}
+
+// RestoreTrash moves a trash entry back into the served directory.
+func (s *Server) RestoreTrash(id string) error {
+	trash := s.getTrash()
+	if trash == nil {
+		return ErrTrashEntryNotFound
+	}
+
+	entry, restored, err := trash.Restore(id)
+	if err != nil {
+		return err
+	}
+
+	s.logger().Info("RESTORE", "id", id, "path", entry.Path, "target", restored)
+
+	s.stateMu.Lock()
+	s.addActivity(Activity{
+		Time:    time.Now(),
+		Client:  "you",
+		Message: fmt.Sprintf("restored %s", restored),
+	})
+	s.stateMu.Unlock()
+
+	s.publish(EvNameFileOp)
+
+	return nil
+}
+
+// PendingClients lists the clients waiting for approval, the longest waiting
+// first.
+func (s *Server) PendingClients() []Client {
+	return s.approvals.Pending()
+}
+
+// Approve lets the client with ip in for as long as the server runs.
+func (s *Server) Approve(ip string) error {
+	return s.decide(ip, true)
+}
+
+// Deny turns the client with ip away for as long as the server runs.
+func (s *Server) Deny(ip string) error {
+	return s.decide(ip, false)
+}
+
+func (s *Server) decide(ip string, approve bool) error {
+	decide, verb := s.approvals.Deny, "denied"
+	if approve {
+		decide, verb = s.approvals.Approve, "approved"
+	}
+	if err := decide(ip); err != nil {
+		return err
+	}
+
+	s.logger().Info("APPROVAL", "clientIP", ip, "decision", verb)
+
+	s.stateMu.Lock()
+	s.addActivity(Activity{
+		Time:    time.Now(),
+		Client:  "you",
+		Message: fmt.Sprintf("%s %s", verb, ip),
+	})
+	s.stateMu.Unlock()
+
+	s.publish(EvNameApprovalRequest)
+
+	return nil
+}
+
+// Shares lists the share links, the newest first.
+func (s *Server) Shares() ([]Share, error) {
+	return s.shares.List()
+}
+
+// CreateShare mints a share link for the file or folder at urlPath and
+// returns it with its URL.
+func (s *Server) CreateShare(urlPath string, opts ShareOptions) (Share, string, error) {
+	share, token, err := s.shares.Create(urlPath, opts)
+	if err != nil {
+		return Share{}, "", err
+	}
+
+	s.logger().Info("SHARE CREATED", "id", share.ID, "path", share.Path, "expires", share.ExpiresAt)
+
+	s.stateMu.Lock()
+	link := ShareURL(s.baseURL, token)
+	s.addActivity(Activity{
+		Time:    time.Now(),
+		Client:  "you",
+		Message: fmt.Sprintf("shared %s", share.Path),
+	})
+	s.stateMu.Unlock()
+
+	s.publish(EvNameFileOp)
+
+	return share, link, nil
+}
+
+// RevokeShare disables the share link with id for good.
+func (s *Server) RevokeShare(id string) error {
+	if err := s.shares.Revoke(id); err != nil {
+		return err
+	}
+
+	s.logger().Info("SHARE REVOKED", "id", id)
+
+	s.stateMu.Lock()
+	s.addActivity(Activity{
+		Time:    time.Now(),
+		Client:  "you",
+		Message: fmt.Sprintf("revoked share %s", id),
+	})
+	s.stateMu.Unlock()
+
+	s.publish(EvNameFileOp)
+
+	return nil
+}
+
+// Ban turns ip away for as long as the server runs and cuts off its open
+// connections, transfers included.
+func (s *Server) Ban(ip string) error {
+	if s.Policy == nil {
+		return ErrNoIPPolicy
+	}
+	if err := s.Policy.Ban(ip); err != nil {
+		return err
+	}
+
+	closed := s.closeConns(ip)
+	s.logger().Warn("BAN", "clientIP", ip, "closedConns", closed)
+
+	s.stateMu.Lock()
+	s.addActivity(Activity{
+		Time:    time.Now(),
+		Client:  "you",
+		Message: fmt.Sprintf("banned %s", ip),
+	})
+	s.stateMu.Unlock()
+
+	s.publish(EvNameBan)
+
+	return nil
+}
+
+// Unban lets ip in again if the policy allows its network.
+func (s *Server) Unban(ip string) error {
+	if s.Policy == nil {
+		return ErrNoIPPolicy
+	}
+	if err := s.Policy.Unban(ip); err != nil {
+		return err
+	}
+
+	s.logger().Info("UNBAN", "clientIP", ip)
+
+	s.stateMu.Lock()
+	s.addActivity(Activity{
+		Time:    time.Now(),
+		Client:  "you",
+		Message: fmt.Sprintf("unbanned %s", ip),
+	})
+	s.stateMu.Unlock()
+
+	s.publish(EvNameBan)
+
+	return nil
+}
+
+// Banned lists the banned IPs.
+func (s *Server) Banned() []string {
+	if s.Policy == nil {
+		return nil
+	}
+	return s.Policy.Banned()
+}
+
+func (s *Server) trackConn(conn net.Conn, state http.ConnState) {
+	s.netConnsMu.Lock()
+	defer s.netConnsMu.Unlock()
+
+	switch state {
+	case http.StateNew:
+		if s.netConns == nil {
+			s.netConns = make(map[net.Conn]struct{})
+		}
+		s.netConns[conn] = struct{}{}
+	case http.StateClosed, http.StateHijacked:
+		delete(s.netConns, conn)
+	}
+}
+
+// closeConns closes the open connections of ip and returns how many there
+// were.
+func (s *Server) closeConns(ip string) int {
+	addr, err := parseAddr(ip)
+	if err != nil {
+		return 0
+	}
+
+	s.netConnsMu.Lock()
+	defer s.netConnsMu.Unlock()
+
+	closed := 0
+	for conn := range s.netConns {
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			continue
+		}
+		if remote, err := parseAddr(host); err == nil && remote == addr {
+			conn.Close()
+			closed++
+		}
+	}
+	return closed
+}
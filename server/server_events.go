@@ -5,11 +5,21 @@ import "time"
 type ServerEventName string
 
 const (
-	EvNameConnOpen      ServerEventName = "conn_open"
-	EvNameConnClose     ServerEventName = "conn_close"
-	EvNameDownloadStart ServerEventName = "download_start"
-	EvNameFileProgress  ServerEventName = "file_progress"
-	EvNameAddrUpdated   ServerEventName = "addr_updated"
+	EvNameConnOpen         ServerEventName = "conn_open"
+	EvNameConnClose        ServerEventName = "conn_close"
+	EvNameDownloadStart    ServerEventName = "download_start"
+	EvNameDownloadComplete ServerEventName = "download_complete"
+	EvNameDownloadFailed   ServerEventName = "download_failed"
+	EvNameFileProgress     ServerEventName = "file_progress"
+	EvNameAddrUpdated      ServerEventName = "addr_updated"
+	EvNameUploadStart      ServerEventName = "upload_start"
+	EvNameUploadProgress   ServerEventName = "upload_progress"
+	EvNameUploadComplete   ServerEventName = "upload_complete"
+	EvNameFileOp           ServerEventName = "file_op"
+	EvNameError            ServerEventName = "error"
+	EvNameShutdown         ServerEventName = "shutdown"
+	EvNameApprovalRequest  ServerEventName = "approval_request"
+	EvNameBan              ServerEventName = "ban"
 )
 
 type EventConnOpen struct {
@@ -31,17 +41,88 @@ type EventDownloadStart struct {
 	Time      time.Time
 }
 
+// EventDownloadComplete is published when a file or archive was sent in full.
+// Bytes counts what went over the wire.
+type EventDownloadComplete struct {
+	ConnID   string
+	FileName string
+	Bytes    int64
+	Duration time.Duration
+	Time     time.Time
+}
+
+// EventDownloadFailed is published when a download broke off, usually because
+// the client went away.
+type EventDownloadFailed struct {
+	ConnID   string
+	FileName string
+	Bytes    int64
+	Err      error
+	Time     time.Time
+}
+
 type EventConnClose struct {
 	ConnID string
 	Time   time.Time
 }
 
+// EventFileProgress carries the number of bytes sent since the previous
+// progress event of the connection.
 type EventFileProgress struct {
 	ConnID string
 	Sent   int
 	Time   time.Time
 }
 
+// EventUploadStart is published when a client starts sending a file.
+// TotalSize is -1 when the size is not known up front.
+type EventUploadStart struct {
+	ConnID    string
+	FileName  string
+	TotalSize int64
+	Time      time.Time
+}
+
+// EventUploadProgress carries the number of bytes received so far.
+type EventUploadProgress struct {
+	ConnID   string
+	Received int64
+	Time     time.Time
+}
+
+type EventUploadComplete struct {
+	ConnID   string
+	FileName string
+	Size     int64
+	Time     time.Time
+}
+
+// EventFileOp is published after a client changed the served directory.
+// Target is the new URL path for mkdir, rename and move and empty for delete.
+type EventFileOp struct {
+	ConnID string
+	Op     FileOp
+	Path   string
+	Target string
+	Time   time.Time
+}
+
+// EventError is published when a request is answered with an error status.
+type EventError struct {
+	ConnID     string
+	StatusCode int
+	Message    string
+	Err        error
+	Time       time.Time
+}
+
+// EventApprovalRequest is published when a client that has to be approved
+// connects for the first time.
+type EventApprovalRequest struct {
+	Client *Client
+	Time   time.Time
+}
+
 type ServerEvent interface {
 	EventName() ServerEventName
 }
@@ -58,3 +139,27 @@ func (e EventFileProgress) EventName() ServerEventName {
 func (e EventDownloadStart) EventName() ServerEventName {
 	return EvNameDownloadStart
 }
+func (e EventDownloadComplete) EventName() ServerEventName {
+	return EvNameDownloadComplete
+}
+func (e EventDownloadFailed) EventName() ServerEventName {
+	return EvNameDownloadFailed
+}
+func (e EventUploadStart) EventName() ServerEventName {
+	return EvNameUploadStart
+}
+func (e EventUploadProgress) EventName() ServerEventName {
+	return EvNameUploadProgress
+}
+func (e EventUploadComplete) EventName() ServerEventName {
+	return EvNameUploadComplete
+}
+func (e EventFileOp) EventName() ServerEventName {
+	return EvNameFileOp
+}
+func (e EventError) EventName() ServerEventName {
+	return EvNameError
+}
+func (e EventApprovalRequest) EventName() ServerEventName {
+	return EvNameApprovalRequest
+}
@@ -7,21 +7,61 @@ import (
 type Client struct {
 	IP          string
 	Host        string
+	Device      string // guessed from the User-Agent, e.g. "iPhone"
 	UserAgent   string
 	ConnectedAt time.Time
 }
 
 type Conn struct {
-	ID        string
-	Client    *Client
-	TotalSent int64
-	CurSpeed  int64
-	UpdatedAt time.Time
-	Filename  string
+	ID            string
+	Client        *Client
+	TotalSent     int64
+	TotalReceived int64
+	CurSpeed      int64
+	UpdatedAt     time.Time
+	Filename      string
+}
+
+// Activity is a single line of the recent activity feed, e.g. a finished upload.
+type Activity struct {
+	Time    time.Time
+	Client  string
+	Message string
 }
 
 type ServerState struct {
-	Dir   string
-	Addr  *string
-	Conns map[string]*Conn
+	Dir      string
+	Addr     *string
+	Upload   bool
+	Conns    map[string]*Conn
+	Activity []Activity
+	// Fingerprint is the SHA-256 fingerprint of the TLS certificate, empty
+	// without TLS.
+	Fingerprint string
+	// ShuttingDown is set once the server stopped accepting connections.
+	ShuttingDown bool
+}
+
+// clone returns a deep copy of the state that shares no memory with s.
+func (s *ServerState) clone() ServerState {
+	c := *s
+
+	if s.Addr != nil {
+		addr := *s.Addr
+		c.Addr = &addr
+	}
+
+	c.Conns = make(map[string]*Conn, len(s.Conns))
+	for id, conn := range s.Conns {
+		connCopy := *conn
+		if conn.Client != nil {
+			client := *conn.Client
+			connCopy.Client = &client
+		}
+		c.Conns[id] = &connCopy
+	}
+
+	c.Activity = append([]Activity(nil), s.Activity...)
+
+	return c
 }
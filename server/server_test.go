@@ -1,9 +1,38 @@
 package server
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"testing/fstest"
+	"time"
+
+	"go.sakib.dev/le/pkg/utils"
 )
 
 func TestServer_Start(t *testing.T) {
@@ -53,3 +82,2199 @@ func TestServer_PartialDownload(t *testing.T) {
 		t.Error("Expected Content-Range header, got none")
 	}
 }
+
+// newTestHandler returns a handler for dir whose events are drained and discarded.
+func newTestHandler(t *testing.T, dir string, upload bool) http.Handler {
+	t.Helper()
+
+	dir, err := utils.ValidAbsDir(dir)
+	if err != nil {
+		t.Fatalf("Invalid test directory: %v", err)
+	}
+
+	ch := make(chan ServerEvent)
+	t.Cleanup(func() { close(ch) })
+	go func() {
+		for range ch {
+		}
+	}()
+
+	var trash *Trash
+	if upload {
+		trash, err = newTrashAt(t.TempDir(), dir, DefaultTrashRetention)
+		if err != nil {
+			t.Fatalf("Failed to create trash: %v", err)
+		}
+	}
+
+	h, err := NewHandler(WithRoot(dir), WithUpload(upload), WithTrash(trash), WithEventSink(ch))
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	return h
+}
+
+// newEventHandler returns a handler for dir publishing its events on ch.
+func newEventHandler(t *testing.T, dir string, ch chan<- ServerEvent, opts ...Option) http.Handler {
+	t.Helper()
+
+	h, err := NewHandler(append([]Option{WithRoot(dir), WithEventSink(ch)}, opts...)...)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	return h
+}
+
+func TestHandler_Upload(t *testing.T) {
+	dir := t.TempDir()
+	ts := httptest.NewServer(newTestHandler(t, dir, true))
+	defer ts.Close()
+
+	upload := func(content string) int {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("files", "../../hello.txt")
+		fw.Write([]byte(content))
+		mw.Close()
+
+		resp, err := http.Post(ts.URL+"/", mw.FormDataContentType(), body)
+		if err != nil {
+			t.Errorf("Failed to POST upload: %v", err)
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := upload("hello"); code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", code)
+	}
+	if code := upload("hello"); code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", code)
+	}
+
+	for _, name := range []string{"hello.txt", "hello (1).txt"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Expected uploaded file %s: %v", name, err)
+		}
+		if string(data) != "hello" {
+			t.Errorf("Unexpected content in %s: %q", name, data)
+		}
+	}
+
+	// uploads of the same name at the same time each get a name of their own
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code := upload(fmt.Sprint("upload ", i)); code != http.StatusCreated {
+				t.Errorf("Expected status 201, got %d", code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var contents []string
+	for i := range 8 {
+		data, _ := os.ReadFile(filepath.Join(dir, fmt.Sprintf("hello (%d).txt", i+2)))
+		contents = append(contents, string(data))
+	}
+	slices.Sort(contents)
+	for i, content := range contents {
+		if want := fmt.Sprint("upload ", i); content != want {
+			t.Errorf("Expected every upload to be kept, got %q", contents)
+			break
+		}
+	}
+}
+
+func TestHandler_UploadDisabled(t *testing.T) {
+	ts := httptest.NewServer(newTestHandler(t, t.TempDir(), false))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/", "multipart/form-data; boundary=x", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("Failed to POST: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandler_Put(t *testing.T) {
+	dir := t.TempDir()
+	ts := httptest.NewServer(newTestHandler(t, dir, true))
+	defer ts.Close()
+
+	put := func(path, body string) int {
+		req, _ := http.NewRequest(http.MethodPut, ts.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to PUT %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := put("/build.tar", "first"); status != http.StatusCreated {
+		t.Errorf("Expected status 201, got %d", status)
+	}
+	if status := put("/build.tar", "second"); status != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", status)
+	}
+	if status := put("/missing/build.tar", "data"); status != http.StatusConflict {
+		t.Errorf("Expected status 409 for missing parent, got %d", status)
+	}
+	if status := put("/", "data"); status != http.StatusConflict {
+		t.Errorf("Expected status 409 for directory, got %d", status)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "build.tar"))
+	if err != nil || string(data) != "second" {
+		t.Errorf("Expected replaced content %q, got %q (%v)", "second", data, err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected no temporary files to be left behind, got %d entries", len(entries))
+	}
+}
+
+func TestHandler_TusUpload(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "sub"), 0o755)
+	h := newTestHandler(t, dir, true)
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	do := func(method, url string, headers map[string]string, body string) *http.Response {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, url, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := do(http.MethodPost, ts.URL+tusPath, map[string]string{
+		"Upload-Length":   "11",
+		"Upload-Metadata": "filename aGVsbG8udHh0,dir L3N1Yg==", // hello.txt, /sub
+	}, "")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", resp.StatusCode)
+	}
+	location := ts.URL + resp.Header.Get("Location")
+
+	patch := func(offset, body string) *http.Response {
+		return do(http.MethodPatch, location, map[string]string{
+			"Content-Type":  tusContentType,
+			"Upload-Offset": offset,
+		}, body)
+	}
+
+	if resp := patch("0", "hello "); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", resp.StatusCode)
+	}
+	if resp := patch("0", "hello "); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 for stale offset, got %d", resp.StatusCode)
+	}
+
+	resp = do(http.MethodHead, location, nil, "")
+	if got := resp.Header.Get("Upload-Offset"); got != "6" {
+		t.Fatalf("Expected Upload-Offset 6, got %q", got)
+	}
+
+	if resp := patch("6", "world"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", resp.StatusCode)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "sub", "hello.txt"))
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("Expected completed upload %q, got %q (%v)", "hello world", data, err)
+	}
+
+	if resp := do(http.MethodHead, location, nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected finished upload to be gone, got %d", resp.StatusCode)
+	}
+
+	if resp := do(http.MethodGet, ts.URL+"/sub/../.le/uploads/", nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected state directory to be hidden, got %d", resp.StatusCode)
+	}
+
+	for target, want := range map[string]int{"/missing": http.StatusNotFound, "/sub/hello.txt": http.StatusNotFound, "/.le": http.StatusForbidden} {
+		resp := do(http.MethodPost, ts.URL+tusPath, map[string]string{
+			"Upload-Length":   "1",
+			"Upload-Metadata": "filename YS50eHQ=,dir " + base64.StdEncoding.EncodeToString([]byte(target)),
+		}, "")
+		if resp.StatusCode != want {
+			t.Errorf("Expected status %d for an upload into %s, got %d", want, target, resp.StatusCode)
+		}
+	}
+
+	// a termination waits for the PATCH that is writing
+	resp = do(http.MethodPost, ts.URL+tusPath, map[string]string{"Upload-Length": "1", "Upload-Metadata": "filename YS50eHQ="}, "")
+	id := path.Base(resp.Header.Get("Location"))
+	unlock, _ := h.(*handler).tus.lock(id)
+	if resp := do(http.MethodDelete, ts.URL+tusPath+id, nil, ""); resp.StatusCode != http.StatusLocked {
+		t.Errorf("Expected status 423 while the upload is written, got %d", resp.StatusCode)
+	}
+	unlock()
+	if resp := do(http.MethodDelete, ts.URL+tusPath+id, nil, ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandler_FileOps(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644)
+	ts := httptest.NewServer(newTestHandler(t, dir, true))
+	defer ts.Close()
+
+	op := func(name string, fields map[string]string) int {
+		form := make(url.Values)
+		for k, v := range fields {
+			form.Set(k, v)
+		}
+		resp, err := http.PostForm(ts.URL+opsPath+name, form)
+		if err != nil {
+			t.Fatalf("Failed to POST %s: %v", name, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	steps := []struct {
+		op     string
+		fields map[string]string
+		want   int
+	}{
+		{"mkdir", map[string]string{"path": "/", "name": "docs"}, http.StatusNoContent},
+		{"mkdir", map[string]string{"path": "/", "name": "docs"}, http.StatusConflict},
+		{"rename", map[string]string{"path": "/a.txt", "name": "b.txt"}, http.StatusNoContent},
+		{"move", map[string]string{"path": "/b.txt", "dest": "/docs"}, http.StatusNoContent},
+		{"move", map[string]string{"path": "/docs", "dest": "/docs"}, http.StatusBadRequest},
+		{"move", map[string]string{"path": "/docs/b.txt", "dest": "/../"}, http.StatusNoContent},
+		{"rename", map[string]string{"path": "/b.txt", "name": "../../x.txt"}, http.StatusNoContent},
+		{"delete", map[string]string{"path": "/"}, http.StatusBadRequest},
+		{"delete", map[string]string{"path": "/.le"}, http.StatusForbidden},
+		{"delete", map[string]string{"path": "/docs"}, http.StatusNoContent},
+		{"delete", map[string]string{"path": "/docs"}, http.StatusNotFound},
+	}
+	for _, step := range steps {
+		if got := op(step.op, step.fields); got != step.want {
+			t.Errorf("%s %v: expected status %d, got %d", step.op, step.fields, step.want, got)
+		}
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "x.txt" {
+		t.Errorf("Expected only x.txt to remain, got %v", entries)
+	}
+
+	// a file that shows up while the entry is renamed is left alone
+	h, err := NewHandler(WithFS(racingFS{DirFS(dir)}), WithUpload(true))
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, opsPath+"rename", strings.NewReader("path=/x.txt&name=y.txt"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a name taken meanwhile, got %d", w.Code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "y.txt")); string(data) != "theirs" {
+		t.Errorf("Expected the other file to be kept, got %q", data)
+	}
+}
+
+// racingFS creates newname right before every rename that must not replace it.
+type racingFS struct {
+	WritableFS
+}
+
+func (r racingFS) RenameNoReplace(oldname, newname string) error {
+	if f, err := r.OpenFile(newname, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644); err == nil {
+		f.Write([]byte("theirs"))
+		f.Close()
+	}
+	return r.WritableFS.RenameNoReplace(oldname, newname)
+}
+
+func TestHandler_RejectsCrossSiteRequests(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644)
+	h := newTestHandler(t, dir, true)
+
+	send := func(method, target string, body io.Reader, header ...string) int {
+		req := httptest.NewRequest(method, target, body)
+		req.Host = "192.168.1.5:8080"
+		if method == http.MethodPost {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	deleteForm := func() io.Reader { return strings.NewReader("path=%2Fa.txt") }
+
+	rejected := [][]string{
+		{"Origin", "http://evil.example"},
+		{"Origin", "null"},
+		{"Origin", "http://192.168.1.5:9999"},
+		{"Sec-Fetch-Site", "cross-site"},
+		{"Sec-Fetch-Site", "cross-site", "Origin", "http://192.168.1.5:8080"},
+	}
+	for _, header := range rejected {
+		if code := send(http.MethodPost, opsPath+"delete", deleteForm(), header...); code != http.StatusForbidden {
+			t.Errorf("Expected a delete with %v to be rejected, got %d", header, code)
+		}
+		if code := send(http.MethodPut, "/b.txt", strings.NewReader("b"), header...); code != http.StatusForbidden {
+			t.Errorf("Expected an upload with %v to be rejected, got %d", header, code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Fatalf("Expected a.txt to survive cross-site requests: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.txt")); err == nil {
+		t.Error("Expected no cross-site upload to land")
+	}
+
+	if code := send(http.MethodGet, "/a.txt", nil, "Sec-Fetch-Site", "cross-site"); code != http.StatusOK {
+		t.Errorf("Expected cross-site downloads to work, got %d", code)
+	}
+	if code := send(http.MethodPut, "/b.txt", strings.NewReader("b")); code != http.StatusCreated {
+		t.Errorf("Expected scripts without Origin to upload, got %d", code)
+	}
+	if code := send(http.MethodPost, opsPath+"delete", deleteForm(), "Origin", "http://192.168.1.5:8080", "Sec-Fetch-Site", "same-origin"); code != http.StatusNoContent {
+		t.Errorf("Expected the browser UI to delete, got %d", code)
+	}
+}
+
+func TestHandler_DirectoryListing(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "visible.txt"), []byte("a"), 0o644)
+	os.WriteFile(filepath.Join(dir, ".hidden"), []byte("a"), 0o644)
+	ts := httptest.NewServer(newTestHandler(t, dir, true))
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+	req.Header.Set("Accept", "text/html")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to GET listing: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), "visible.txt") || strings.Contains(string(body), ".hidden") {
+		t.Errorf("Listing should contain visible.txt and hide dot files")
+	}
+	if !strings.Contains(string(body), `id="upload"`) {
+		t.Errorf("Listing should contain the upload form in read-write mode")
+	}
+}
+
+func TestTrash_PutRestorePurge(t *testing.T) {
+	root := t.TempDir()
+	trash, err := newTrashAt(t.TempDir(), root, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create trash: %v", err)
+	}
+
+	os.Mkdir(filepath.Join(root, "docs"), 0o755)
+	os.WriteFile(filepath.Join(root, "docs", "a.txt"), []byte("a"), 0o644)
+
+	entry, err := trash.Put(filepath.Join(root, "docs"), "/docs", TrashReasonDelete)
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "docs")); !os.IsNotExist(err) {
+		t.Errorf("Expected docs to be moved out of the served directory")
+	}
+
+	// the original name is taken by now
+	os.WriteFile(filepath.Join(root, "docs"), []byte("new"), 0o644)
+
+	_, restored, err := trash.Restore(entry.ID)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if restored != "/docs (1)" {
+		t.Errorf("Expected restore to /docs (1), got %s", restored)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "docs (1)", "a.txt")); string(data) != "a" {
+		t.Errorf("Expected restored content, got %q", data)
+	}
+
+	if _, err := trash.Put(filepath.Join(root, "docs"), "/docs", TrashReasonOverwrite); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if n, _ := trash.Purge(); n != 0 {
+		t.Errorf("Expected fresh entries to survive purge, purged %d", n)
+	}
+
+	trash.retention = 0
+	if n, _ := trash.Purge(); n != 1 {
+		t.Errorf("Expected 1 purged entry, got %d", n)
+	}
+	if entries, _ := trash.List(); len(entries) != 0 {
+		t.Errorf("Expected empty trash, got %v", entries)
+	}
+}
+
+func TestHandler_DirectoryArchive(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "docs", "sub"), 0o755)
+	os.WriteFile(filepath.Join(dir, "docs", "a.txt"), []byte("aaa"), 0o644)
+	os.WriteFile(filepath.Join(dir, "docs", "sub", "b.txt"), []byte("bb"), 0o644)
+	os.WriteFile(filepath.Join(dir, "docs", ".secret"), []byte("s"), 0o644)
+	os.Symlink("/etc/passwd", filepath.Join(dir, "docs", "passwd"))
+
+	ts := httptest.NewServer(newTestHandler(t, dir, false))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/docs?archive=zip")
+	if err != nil {
+		t.Fatalf("Failed to GET archive: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "application/zip" {
+		t.Errorf("Expected application/zip, got %s", resp.Header.Get("Content-Type"))
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("Invalid zip: %v", err)
+	}
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	want := []string{"docs/", "docs/a.txt", "docs/sub/", "docs/sub/b.txt"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected entries %v, got %v", want, names)
+	}
+
+	resp, err = http.Get(ts.URL + "/docs?archive=tar.gz")
+	if err != nil {
+		t.Fatalf("Failed to GET archive: %v", err)
+	}
+	defer resp.Body.Close()
+
+	gr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("Invalid gzip: %v", err)
+	}
+	tr := tar.NewReader(gr)
+	count := 0
+	for {
+		if _, err := tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Invalid tar: %v", err)
+		}
+		count++
+	}
+	if count != len(want) {
+		t.Errorf("Expected %d tar entries, got %d", len(want), count)
+	}
+}
+
+// vanishingFS reports the folder gone as deleted while it is being read.
+type vanishingFS struct {
+	fstest.MapFS
+	gone string
+}
+
+func (v vanishingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name == v.gone {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return v.MapFS.ReadDir(name)
+}
+
+func TestHandler_DirectoryArchiveErrors(t *testing.T) {
+	fsys := vanishingFS{fstest.MapFS{"docs/sub/a.txt": {Data: []byte("a")}}, "docs/sub"}
+	h, err := NewHandler(WithFS(fsys))
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/docs?archive=zip", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a folder deleted meanwhile, got %d", w.Code)
+	}
+}
+
+func TestHandler_SelectionArchive(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "docs"), 0o755)
+	os.WriteFile(filepath.Join(dir, "docs", "b.txt"), []byte("bb"), 0o644)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("aaa"), 0o644)
+
+	ts := httptest.NewServer(newTestHandler(t, dir, false))
+	defer ts.Close()
+
+	resp, err := http.PostForm(ts.URL+zipPath, url.Values{"paths": {"/a.txt", "/docs", "/a.txt"}})
+	if err != nil {
+		t.Fatalf("Failed to POST selection: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("Invalid zip: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if want := "a.txt,docs/,docs/b.txt"; strings.Join(names, ",") != want {
+		t.Errorf("Expected entries %s, got %v", want, names)
+	}
+
+	resp, err = http.PostForm(ts.URL+zipPath, url.Values{"paths": {"/a.txt", "/../../etc/passwd"}})
+	if err != nil {
+		t.Fatalf("Failed to POST selection: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected selection outside the root to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandler_ContentTypeAndDisposition(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "doc.pdf"), []byte("%PDF-1.4"), 0o644)
+	os.WriteFile(filepath.Join(dir, "page.html"), []byte("<html></html>"), 0o644)
+	os.WriteFile(filepath.Join(dir, "noext"), []byte("\x89PNG\r\n\x1a\n0000"), 0o644)
+
+	ts := httptest.NewServer(newTestHandler(t, dir, false))
+	defer ts.Close()
+
+	tests := []struct {
+		path        string
+		contentType string
+		disposition string
+		sandboxed   bool
+	}{
+		{"/doc.pdf", "application/pdf", `inline; filename="doc.pdf"`, false},
+		{"/doc.pdf?download=1", "application/pdf", `attachment; filename="doc.pdf"`, false},
+		{"/noext", "image/png", `inline; filename="noext"`, false},
+		{"/page.html", "text/html; charset=utf-8", `inline; filename="page.html"`, true},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatalf("Failed to GET %s: %v", tt.path, err)
+		}
+		resp.Body.Close()
+
+		if got := resp.Header.Get("Content-Type"); got != tt.contentType {
+			t.Errorf("%s: expected Content-Type %q, got %q", tt.path, tt.contentType, got)
+		}
+		if got := resp.Header.Get("Content-Disposition"); got != tt.disposition {
+			t.Errorf("%s: expected Content-Disposition %q, got %q", tt.path, tt.disposition, got)
+		}
+		if got := resp.Header.Get("Content-Security-Policy") == "sandbox"; got != tt.sandboxed {
+			t.Errorf("%s: expected sandboxed=%v", tt.path, tt.sandboxed)
+		}
+	}
+}
+
+func TestHandler_ConditionalRequests(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "file.txt")
+	os.WriteFile(filePath, []byte("0123456789"), 0o644)
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(filePath, modTime, modTime)
+
+	ts := httptest.NewServer(newTestHandler(t, dir, true))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/file.txt")
+	if err != nil {
+		t.Fatalf("Failed to GET file: %v", err)
+	}
+	resp.Body.Close()
+
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	if etag == "" || lastModified != modTime.Format(http.TimeFormat) {
+		t.Fatalf("Expected validators, got ETag %q and Last-Modified %q", etag, lastModified)
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		status  int
+		body    string
+	}{
+		{"if-none-match", http.MethodGet, map[string]string{"If-None-Match": etag}, http.StatusNotModified, ""},
+		{"if-none-match weak", http.MethodGet, map[string]string{"If-None-Match": `"other", W/` + etag}, http.StatusNotModified, ""},
+		{"if-none-match other", http.MethodGet, map[string]string{"If-None-Match": `"other"`}, http.StatusOK, "0123456789"},
+		{"if-modified-since", http.MethodGet, map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified, ""},
+		{"if-modified-since older", http.MethodGet, map[string]string{"If-Modified-Since": modTime.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK, "0123456789"},
+		{"if-match", http.MethodGet, map[string]string{"If-Match": etag}, http.StatusOK, "0123456789"},
+		{"if-match other", http.MethodGet, map[string]string{"If-Match": `"other"`}, http.StatusPreconditionFailed, ""},
+		{"if-unmodified-since older", http.MethodGet, map[string]string{"If-Unmodified-Since": modTime.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusPreconditionFailed, ""},
+		{"if-range etag", http.MethodGet, map[string]string{"Range": "bytes=5-", "If-Range": etag}, http.StatusPartialContent, "56789"},
+		{"if-range date", http.MethodGet, map[string]string{"Range": "bytes=5-", "If-Range": lastModified}, http.StatusPartialContent, "56789"},
+		{"if-range stale", http.MethodGet, map[string]string{"Range": "bytes=5-", "If-Range": `"other"`}, http.StatusOK, "0123456789"},
+		{"put if-none-match", http.MethodPut, map[string]string{"If-None-Match": "*"}, http.StatusPreconditionFailed, ""},
+		{"put if-match other", http.MethodPut, map[string]string{"If-Match": `"other"`}, http.StatusPreconditionFailed, ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, ts.URL+"/file.txt", strings.NewReader("changed"))
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", tt.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, resp.StatusCode)
+		}
+		if tt.status != http.StatusPreconditionFailed && string(body) != tt.body {
+			t.Errorf("%s: expected body %q, got %q", tt.name, tt.body, body)
+		}
+	}
+
+	// a resumed download of a file that changed in between gets the new file
+	os.WriteFile(filePath, []byte("abcdefghij"), 0o644)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/file.txt", nil)
+	req.Header.Set("Range", "bytes=5-")
+	req.Header.Set("If-Range", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to resume download: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "abcdefghij" {
+		t.Errorf("Expected the whole new file, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestHandler_MultipleRanges(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("0123456789"), 0o644)
+
+	ts := httptest.NewServer(newTestHandler(t, dir, false))
+	defer ts.Close()
+
+	get := func(rng string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/file.txt", nil)
+		req.Header.Set("Range", rng)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to GET range %s: %v", rng, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, body := get("bytes=7-8,0-1,1-2")
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Expected status 206, got %d", resp.StatusCode)
+	}
+	if resp.ContentLength != int64(len(body)) {
+		t.Errorf("Content-Length %d does not match body length %d", resp.ContentLength, len(body))
+	}
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Expected multipart/byteranges, got %q", resp.Header.Get("Content-Type"))
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	want := []struct{ contentRange, data string }{
+		{"bytes 0-2/10", "012"},
+		{"bytes 7-8/10", "78"},
+	}
+	for _, w := range want {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("Failed to read part: %v", err)
+		}
+		data, _ := io.ReadAll(part)
+		if part.Header.Get("Content-Range") != w.contentRange || string(data) != w.data {
+			t.Errorf("Expected part %s %q, got %s %q", w.contentRange, w.data, part.Header.Get("Content-Range"), data)
+		}
+		if ct := part.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+			t.Errorf("Expected part Content-Type text/plain, got %q", ct)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("Expected exactly two parts, got error %v", err)
+	}
+
+	// ranges that merge into one are sent as a plain partial response
+	resp, body = get("bytes=0-3,2-5")
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "012345" || resp.Header.Get("Content-Range") != "bytes 0-5/10" {
+		t.Errorf("Expected single range 0-5, got %d %q %q", resp.StatusCode, resp.Header.Get("Content-Range"), body)
+	}
+
+	// ranges past the end are cut or left out
+	resp, body = get("bytes=8-100,50-60")
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "89" || resp.Header.Get("Content-Range") != "bytes 8-9/10" {
+		t.Errorf("Expected range 8-9, got %d %q %q", resp.StatusCode, resp.Header.Get("Content-Range"), body)
+	}
+	if resp, _ := get("bytes=50-60"); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Expected status 416 for a range past the end, got %d", resp.StatusCode)
+	}
+
+	rng := "bytes=0-0"
+	for i := 2; i <= maxRanges+1; i++ {
+		rng += fmt.Sprintf(",%d-%d", i*2, i*2)
+	}
+	if resp, _ := get(rng); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Expected status 416 for too many ranges, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandler_HeadAndOptions(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("0123456789"), 0o644)
+	os.Mkdir(filepath.Join(dir, "sub"), 0o755)
+
+	ch := make(chan ServerEvent, 100)
+	h := newEventHandler(t, dir, ch)
+
+	for _, target := range []string{"/file.txt", "/sub/", "/sub?archive=zip"} {
+		get := httptest.NewRecorder()
+		h.ServeHTTP(get, httptest.NewRequest(http.MethodGet, target, nil))
+		for len(ch) > 0 {
+			<-ch
+		}
+
+		head := httptest.NewRecorder()
+		h.ServeHTTP(head, httptest.NewRequest(http.MethodHead, target, nil))
+
+		if head.Code != get.Code {
+			t.Errorf("%s: expected HEAD status %d, got %d", target, get.Code, head.Code)
+		}
+		for _, key := range []string{"Content-Type", "Content-Length", "Content-Disposition", "ETag", "Last-Modified"} {
+			if head.Header().Get(key) != get.Header().Get(key) {
+				t.Errorf("%s: expected HEAD %s %q, got %q", target, key, get.Header().Get(key), head.Header().Get(key))
+			}
+		}
+		if head.Body.Len() != 0 && target != "/sub/" { // the listing body is dropped by net/http itself
+			t.Errorf("%s: expected no body for HEAD, got %d bytes", target, head.Body.Len())
+		}
+
+		for len(ch) > 0 {
+			switch ev := (<-ch).(type) {
+			case EventDownloadStart, EventFileProgress:
+				t.Errorf("%s: unexpected event for HEAD: %#v", target, ev)
+			}
+		}
+	}
+
+	for _, upload := range []bool{false, true} {
+		h := newEventHandler(t, dir, ch, WithUpload(upload))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/file.txt", nil))
+
+		want := "GET, HEAD, OPTIONS"
+		if upload {
+			want += ", POST, PUT"
+		}
+		if w.Code != http.StatusNoContent || w.Header().Get("Allow") != want {
+			t.Errorf("upload=%v: expected 204 with Allow %q, got %d %q", upload, want, w.Code, w.Header().Get("Allow"))
+		}
+		for len(ch) > 0 {
+			<-ch
+		}
+	}
+}
+
+// fileReaderFrom records whether ReadFrom was handed the file itself, which is
+// what the network stack needs to use sendfile.
+type fileReaderFrom struct {
+	bytes.Buffer
+	sawFile bool
+}
+
+func (f *fileReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	if lr, ok := r.(*io.LimitedReader); ok {
+		_, f.sawFile = lr.R.(*os.File)
+	}
+	return f.Buffer.ReadFrom(r)
+}
+
+func TestProgressWriter_ReadFrom(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), sendChunkSize/4)
+	filePath := filepath.Join(t.TempDir(), "big.bin")
+	os.WriteFile(filePath, data, 0o644)
+
+	ch := make(chan ServerEvent, 100)
+	req := httptest.NewRequest(http.MethodGet, "/big.bin", nil)
+	reqHelper := newReqHelper(httptest.NewRecorder(), req, ch, slog.Default())
+	reqHelper.attachReqId()
+
+	tests := []struct {
+		name   string
+		offset int64
+		limit  int64
+	}{
+		{"whole file", 0, -1},
+		{"range", 5, int64(len(data)) - 10},
+	}
+	for _, tt := range tests {
+		file, _ := os.Open(filePath)
+		file.Seek(tt.offset, io.SeekStart)
+
+		var src io.Reader = file
+		want := data[tt.offset:]
+		if tt.limit >= 0 {
+			src = io.LimitReader(file, tt.limit)
+			want = want[:tt.limit]
+		}
+
+		dst := &fileReaderFrom{}
+		pw := newProgressWriter(dst, reqHelper, "big.bin", int64(len(want)))
+		n, err := pw.ReadFrom(src)
+		file.Close()
+		reqHelper.flushProgress()
+
+		if err != nil || n != int64(len(want)) || !bytes.Equal(dst.Bytes(), want) {
+			t.Errorf("%s: expected %d bytes, got %d (error %v)", tt.name, len(want), n, err)
+		}
+		if !dst.sawFile {
+			t.Errorf("%s: expected the file to be passed on for sendfile", tt.name)
+		}
+
+		var progress int64
+		for len(ch) > 0 {
+			if ev, ok := (<-ch).(EventFileProgress); ok {
+				progress += int64(ev.Sent)
+			}
+		}
+		if progress != n {
+			t.Errorf("%s: expected progress events for %d bytes, got %d", tt.name, n, progress)
+		}
+	}
+}
+
+func TestReqHelper_ProgressIsCoalesced(t *testing.T) {
+	ch := make(chan ServerEvent, 2)
+	reqHelper := newReqHelper(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), ch, slog.Default())
+	reqHelper.attachReqId()
+
+	done := make(chan struct{})
+	go func() {
+		// nobody reads ch here, progress must neither block nor get lost
+		for i := 0; i < 1000; i++ {
+			reqHelper.publishDownloadProgress(10)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing progress blocked the transfer")
+	}
+
+	var events []ServerEvent
+	for len(ch) > 0 {
+		events = append(events, <-ch)
+	}
+
+	reqHelper.publishConnClose()
+	for len(ch) > 0 {
+		events = append(events, <-ch)
+	}
+
+	var progressEvents, sent int
+	for _, ev := range events {
+		if ev, ok := ev.(EventFileProgress); ok {
+			progressEvents++
+			sent += ev.Sent
+		}
+	}
+
+	if sent != 10000 {
+		t.Errorf("Expected progress for 10000 bytes, got %d", sent)
+	}
+	if progressEvents > 2 {
+		t.Errorf("Expected progress to be coalesced, got %d events", progressEvents)
+	}
+	if _, ok := events[len(events)-1].(EventConnClose); !ok {
+		t.Errorf("Expected the last event to close the connection, got %#v", events[len(events)-1])
+	}
+}
+
+func TestServer_PublishDropsWhenSubscriberLags(t *testing.T) {
+	s := &Server{eventCh: make(chan ServerEventName, 1)}
+
+	for i := 0; i < 3; i++ {
+		s.publish(EvNameFileProgress)
+	}
+
+	if got := s.DroppedEvents(); got != 2 {
+		t.Errorf("Expected 2 dropped events, got %d", got)
+	}
+}
+
+func TestServer_ConcurrentDownloadsAndState(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("x"), 1024*1024)
+	os.WriteFile(filepath.Join(dir, "file.bin"), data, 0o644)
+
+	s, err := NewServer(dir, 0, make(chan ServerEventName, 10))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	ch := make(chan ServerEvent, 100)
+	go s.listenForData(ch)
+
+	ts := httptest.NewServer(newEventHandler(t, s.Dir, ch))
+	defer ts.Close()
+
+	stop := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			state := s.GetState()
+			for _, conn := range state.Conns {
+				_ = conn.TotalSent + int64(len(conn.Filename)) + int64(len(conn.Client.Host))
+			}
+			// snapshots must not share memory with the server
+			state.Conns["snapshot"] = &Conn{}
+		}
+	}()
+
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func() {
+			resp, err := http.Get(ts.URL + "/file.bin")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			if err == nil && len(body) != len(data) {
+				err = fmt.Errorf("expected %d bytes, got %d", len(data), len(body))
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Download failed: %v", err)
+		}
+	}
+
+	close(stop)
+	<-readerDone
+
+	if _, exists := s.GetState().Conns["snapshot"]; exists {
+		t.Error("Changing a snapshot changed the server state")
+	}
+}
+
+func TestServer_Subscribe(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("x"), 64*1024)
+	os.WriteFile(filepath.Join(dir, "file.bin"), data, 0o644)
+
+	s, err := NewServer(dir, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	ch := make(chan ServerEvent, 100)
+	go s.listenForData(ch)
+	defer close(ch)
+
+	downloads, cancelDownloads := s.Subscribe(EventNames(EvNameDownloadStart, EvNameDownloadComplete))
+	all, cancelAll := s.Subscribe(nil)
+	defer cancelAll()
+
+	ts := httptest.NewServer(newEventHandler(t, s.Dir, ch))
+	defer ts.Close()
+
+	for _, p := range []string{"/file.bin", "/missing"} {
+		resp, err := http.Get(ts.URL + p)
+		if err != nil {
+			t.Fatalf("Failed to GET %s: %v", p, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	next := func(ch <-chan ServerEvent) ServerEvent {
+		select {
+		case ev := <-ch:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for event")
+			return nil
+		}
+	}
+
+	if ev, ok := next(downloads).(EventDownloadStart); !ok || ev.FileName != "file.bin" {
+		t.Errorf("Expected download start of file.bin, got %#v", ev)
+	}
+	ev, ok := next(downloads).(EventDownloadComplete)
+	if !ok || ev.Bytes != int64(len(data)) || ev.Duration <= 0 {
+		t.Errorf("Expected download complete with %d bytes, got %#v", len(data), ev)
+	}
+
+	var names []ServerEventName
+	for {
+		ev := next(all)
+		names = append(names, ev.EventName())
+		if e, ok := ev.(EventError); ok {
+			if e.StatusCode != http.StatusNotFound {
+				t.Errorf("Expected error event with status 404, got %d", e.StatusCode)
+			}
+			break
+		}
+	}
+	for _, want := range []ServerEventName{EvNameConnOpen, EvNameDownloadStart, EvNameFileProgress, EvNameDownloadComplete, EvNameConnClose} {
+		if !slices.Contains(names, want) {
+			t.Errorf("Expected a %s event, got %v", want, names)
+		}
+	}
+
+	cancelDownloads()
+	cancelDownloads()
+	if _, open := <-downloads; open {
+		t.Error("Expected the channel to be closed after cancel")
+	}
+}
+
+func TestNewHandler_Options(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("hello"), 0o644)
+	os.WriteFile(filepath.Join(dir, ".secret"), []byte("hidden"), 0o644)
+
+	defaultLogger := slog.Default()
+	var logs bytes.Buffer
+
+	h, err := NewHandler(
+		WithRoot(dir),
+		WithBasePath("/files/"),
+		WithHiddenFiles(HiddenDeny),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+		WithAuth(func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Header.Get("X-Token") != "ok" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return false
+			}
+			return true
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	if slog.Default() != defaultLogger {
+		t.Error("NewHandler changed the default logger")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/files/", h)
+	mux.Handle("/files", h)
+
+	tests := []struct {
+		path     string
+		token    string
+		status   int
+		location string
+	}{
+		{"/files/file.txt", "ok", http.StatusOK, ""},
+		{"/files/file.txt", "", http.StatusUnauthorized, ""},
+		{"/files/.secret", "ok", http.StatusForbidden, ""},
+		{"/files", "ok", http.StatusMovedPermanently, "/files/"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Header.Set("X-Token", tt.token)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.path, tt.status, w.Code)
+		}
+		if tt.location != "" && w.Header().Get("Location") != tt.location {
+			t.Errorf("%s: expected Location %q, got %q", tt.path, tt.location, w.Header().Get("Location"))
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/files/", nil)
+	req.Header.Set("X-Token", "ok")
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if !strings.Contains(w.Body.String(), `href="/files/file.txt"`) {
+		t.Error("Expected links in the listing to include the base path")
+	}
+	if strings.Contains(w.Body.String(), ".secret") {
+		t.Error("Expected hidden files to be left out of the listing")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/files/", nil)
+	req.Header.Set("X-Token", "ok")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if !strings.Contains(w.Body.String(), "file.txt") || strings.Contains(w.Body.String(), ".secret") {
+		t.Errorf("Expected the plain listing without hidden files, got %q", w.Body.String())
+	}
+
+	if !strings.Contains(logs.String(), "REQUEST") {
+		t.Error("Expected requests to be logged to the configured logger")
+	}
+
+	// requests outside the base path are not served
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file.txt", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 outside the base path, got %d", w.Code)
+	}
+
+	if _, err := NewHandler(WithRoot(filepath.Join(dir, "missing"))); err == nil {
+		t.Error("Expected an error for a missing root directory")
+	}
+}
+
+// unseekableFS serves the files of an fs.FS without io.Seeker, like a network
+// backed file system would.
+type unseekableFS struct{ fs.FS }
+
+type unseekableFile struct{ fs.File }
+
+func (s unseekableFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return unseekableFile{f}, nil
+}
+
+func TestNewHandler_FS(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"docs/a.txt":        {Data: []byte("0123456789"), ModTime: modTime},
+		"docs/sub/b.txt":    {Data: []byte("bb"), ModTime: modTime},
+		"docs/.secret":      {Data: []byte("s"), ModTime: modTime},
+		stateDirName + "/x": {Data: []byte("state"), ModTime: modTime},
+	}
+
+	if _, err := NewHandler(WithFS(fsys), WithUpload(true)); !errors.Is(err, ErrReadOnlyFS) {
+		t.Errorf("Expected ErrReadOnlyFS for uploads to a read-only FS, got %v", err)
+	}
+
+	h, err := NewHandler(WithFS(fsys))
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	tests := []struct {
+		path   string
+		header map[string]string
+		status int
+		body   string
+	}{
+		{"/docs/a.txt", nil, http.StatusOK, "0123456789"},
+		{"/docs/a.txt", map[string]string{"Range": "bytes=2-4"}, http.StatusPartialContent, "234"},
+		{"/docs/a.txt", map[string]string{"If-Modified-Since": modTime.Format(http.TimeFormat)}, http.StatusNotModified, ""},
+		{"/docs/missing.txt", nil, http.StatusNotFound, ""},
+		{"/" + stateDirName + "/x", nil, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.status {
+			t.Errorf("%s %v: expected status %d, got %d", tt.path, tt.header, tt.status, w.Code)
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s %v: expected body %q, got %q", tt.path, tt.header, tt.body, w.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/docs/", nil)
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `href="/docs/a.txt"`) || strings.Contains(w.Body.String(), ".secret") {
+		t.Errorf("Expected a listing of docs without hidden files, got %q", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?archive=zip", nil))
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("Invalid zip: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	want := []string{"files/", "files/docs/", "files/docs/a.txt", "files/docs/sub/", "files/docs/sub/b.txt"}
+	if !slices.Equal(names, want) {
+		t.Errorf("Expected entries %v, got %v", want, names)
+	}
+
+	// files that can't seek are sent whole
+	h, err = NewHandler(WithFS(unseekableFS{fsys}))
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/docs/a.txt", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" || w.Header().Get("Accept-Ranges") != "none" {
+		t.Errorf("Expected the whole file without range support, got %d %q Accept-Ranges %q", w.Code, w.Body.String(), w.Header().Get("Accept-Ranges"))
+	}
+}
+
+// recordingFS records the changes made through a WritableFS.
+type recordingFS struct {
+	WritableFS
+	ops *[]string
+}
+
+func (r recordingFS) Mkdir(name string, perm fs.FileMode) error {
+	*r.ops = append(*r.ops, "mkdir "+name)
+	return r.WritableFS.Mkdir(name, perm)
+}
+
+func (r recordingFS) Rename(oldname, newname string) error {
+	*r.ops = append(*r.ops, "rename "+path.Dir(oldname)+" "+newname)
+	return r.WritableFS.Rename(oldname, newname)
+}
+
+func (r recordingFS) RenameNoReplace(oldname, newname string) error {
+	*r.ops = append(*r.ops, "rename "+path.Dir(oldname)+" "+newname)
+	return r.WritableFS.RenameNoReplace(oldname, newname)
+}
+
+func (r recordingFS) RemoveAll(name string) error {
+	*r.ops = append(*r.ops, "removeall "+name)
+	return r.WritableFS.RemoveAll(name)
+}
+
+func TestNewHandler_WritableFS(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0o644)
+	os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(dir, "link.txt"))
+
+	var ops []string
+	h, err := NewHandler(WithFS(recordingFS{DirFS(dir), &ops}), WithUpload(true))
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	do := func(method, target string, body io.Reader, contentType string) int {
+		req := httptest.NewRequest(method, target, body)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	form := func(values url.Values) io.Reader { return strings.NewReader(values.Encode()) }
+	const formType = "application/x-www-form-urlencoded"
+
+	if code := do(http.MethodPost, opsPath+"mkdir", form(url.Values{"path": {"/"}, "name": {"docs"}}), formType); code != http.StatusNoContent {
+		t.Fatalf("Expected mkdir to succeed, got %d", code)
+	}
+	if code := do(http.MethodPut, "/docs/a.txt", strings.NewReader("aaa"), ""); code != http.StatusCreated {
+		t.Fatalf("Expected PUT to succeed, got %d", code)
+	}
+	if code := do(http.MethodPost, opsPath+"delete", form(url.Values{"path": {"/link.txt"}}), formType); code != http.StatusNoContent {
+		t.Fatalf("Expected delete to succeed, got %d", code)
+	}
+
+	want := []string{"mkdir docs", "rename docs docs/a.txt", "removeall link.txt"}
+	if !slices.Equal(ops, want) {
+		t.Errorf("Expected the changes %q to go through the file system, got %q", want, ops)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "secret.txt")); err != nil || string(data) != "secret" {
+		t.Errorf("Expected deleting a symlink to leave its target alone, got %q: %v", data, err)
+	}
+
+	// resumable uploads keep their state in the file system too
+	ops = nil
+	tus := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Tus-Resumable", tusVersion)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte("b.txt")) + ",dir " + base64.StdEncoding.EncodeToString([]byte("/docs"))
+	w := tus(http.MethodPost, tusPath, "", "Upload-Length", "3", "Upload-Metadata", meta)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected the upload to be created, got %d", w.Code)
+	}
+	if w := tus(http.MethodPatch, w.Header().Get("Location"), "bbb", "Content-Type", tusContentType, "Upload-Offset", "0"); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the upload to finish, got %d", w.Code)
+	}
+	if !slices.Contains(ops, "mkdir .le/uploads") || !slices.Contains(ops, "rename .le/uploads docs/b.txt") {
+		t.Errorf("Expected the resumable upload to go through the file system, got %q", ops)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "docs", "b.txt")); err != nil || string(data) != "bbb" {
+		t.Errorf("Expected the uploaded file, got %q: %v", data, err)
+	}
+
+	// the trash moves entries on disk
+	trash, err := newTrashAt(t.TempDir(), dir, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create trash: %v", err)
+	}
+	if _, err := NewHandler(WithFS(recordingFS{DirFS(dir), &ops}), WithTrash(trash)); !errors.Is(err, ErrNotOSDir) {
+		t.Errorf("Expected ErrNotOSDir for a trash without a directory, got %v", err)
+	}
+	if _, err := NewHandler(WithFS(DirFS(dir)), WithTrash(trash)); err != nil {
+		t.Errorf("Expected a trash for DirFS, got %v", err)
+	}
+}
+
+func TestHandler_BrowseArchives(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "builds"), 0o755)
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	fw, _ := zw.CreateHeader(&zip.FileHeader{Name: "bin/app", Method: zip.Store})
+	fw.Write([]byte("0123456789"))
+	fw, _ = zw.Create("readme.txt")
+	fw.Write([]byte("read me"))
+	zw.Close()
+	os.WriteFile(filepath.Join(dir, "builds", "app.zip"), zipBuf.Bytes(), 0o644)
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	tw.WriteHeader(&tar.Header{Name: "bin/app", Mode: 0o644, Size: 10, Typeflag: tar.TypeReg})
+	tw.Write([]byte("0123456789"))
+	tw.WriteHeader(&tar.Header{Name: "readme.txt", Mode: 0o644, Size: 7, Typeflag: tar.TypeReg})
+	tw.Write([]byte("read me"))
+	tw.Close()
+	os.WriteFile(filepath.Join(dir, "builds", "app.tar"), tarBuf.Bytes(), 0o644)
+
+	var tgzBuf bytes.Buffer
+	gw := gzip.NewWriter(&tgzBuf)
+	gw.Write(tarBuf.Bytes())
+	gw.Close()
+	os.WriteFile(filepath.Join(dir, "builds", "app.tar.gz"), tgzBuf.Bytes(), 0o644)
+
+	h := newTestHandler(t, dir, false)
+
+	tests := []struct {
+		path         string
+		rng          string
+		status       int
+		body         string
+		acceptRanges string
+	}{
+		{"/builds/app.zip/bin/app", "", http.StatusOK, "0123456789", "bytes"},
+		{"/builds/app.zip/bin/app", "bytes=2-4", http.StatusPartialContent, "234", "bytes"},
+		{"/builds/app.zip/readme.txt", "bytes=2-4", http.StatusOK, "read me", "none"},
+		{"/builds/app.zip/missing.txt", "", http.StatusNotFound, "", ""},
+		{"/builds/app.tar/bin/app", "bytes=2-4", http.StatusPartialContent, "234", "bytes"},
+		{"/builds/app.tar/readme.txt", "", http.StatusOK, "read me", "bytes"},
+		{"/builds/app.tar.gz/readme.txt", "bytes=2-4", http.StatusOK, "read me", "none"},
+		{"/builds/app.tar.gz/bin/app", "", http.StatusOK, "0123456789", "none"},
+		{"/builds/app.zip", "", http.StatusOK, zipBuf.String(), "bytes"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.rng != "" {
+			req.Header.Set("Range", tt.rng)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.status {
+			t.Errorf("%s %s: expected status %d, got %d", tt.path, tt.rng, tt.status, w.Code)
+			continue
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s %s: expected body %q, got %q", tt.path, tt.rng, tt.body, w.Body.String())
+		}
+		if tt.acceptRanges != "" && w.Header().Get("Accept-Ranges") != tt.acceptRanges {
+			t.Errorf("%s: expected Accept-Ranges %q, got %q", tt.path, tt.acceptRanges, w.Header().Get("Accept-Ranges"))
+		}
+	}
+
+	for _, archive := range []string{"app.zip", "app.tar", "app.tar.gz"} {
+		req := httptest.NewRequest(http.MethodGet, "/builds/"+archive+"/", nil)
+		req.Header.Set("Accept", "text/html")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		body := w.Body.String()
+		if w.Code != http.StatusOK || !strings.Contains(body, `href="/builds/`+archive+`/bin"`) || !strings.Contains(body, `href="/builds/`+archive+`/readme.txt"`) {
+			t.Errorf("%s: expected a listing of the archive, got %d %q", archive, w.Code, body)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/builds/", nil)
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `href="/builds/app.zip/"`) {
+		t.Error("Expected a link to browse the archive")
+	}
+}
+
+func TestServer_ShutdownDrainsTransfers(t *testing.T) {
+	dir := t.TempDir()
+	f, _ := os.Create(filepath.Join(dir, "big.bin"))
+	f.Truncate(64 * 1024 * 1024)
+	f.Close()
+
+	s, err := NewServer(dir, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	port := s.Port
+	started := make(chan error, 1)
+	go func() { started <- s.Serve() }()
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/big.bin", port))
+	if err != nil {
+		t.Fatalf("Failed to GET file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// the transfer is stuck until the body is read
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before the transfer finished: %v", err)
+	default:
+	}
+	if !s.GetState().ShuttingDown {
+		t.Error("Expected the state to report the shutdown")
+	}
+	if _, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+		t.Error("Expected new connections to be refused")
+	}
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil || n != 64*1024*1024 {
+		t.Errorf("Expected the whole file to be sent, got %d bytes: %v", n, err)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if err := <-started; err != nil {
+		t.Errorf("Expected Start to return nil after a shutdown, got %v", err)
+	}
+}
+
+func TestServer_ListenPortFallback(t *testing.T) {
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer taken.Close()
+	port := taken.Addr().(*net.TCPAddr).Port
+
+	s, _ := NewServer(t.TempDir(), port, nil)
+	if err := s.Listen(); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("Expected EADDRINUSE without fallback, got %v", err)
+	}
+
+	s.PortFallback = true
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Expected to fall back to another port, got %v", err)
+	}
+	defer s.listener.Close()
+
+	if s.Port == port {
+		t.Errorf("Expected a port other than %d", port)
+	}
+	if addr := s.GetState().Addr; addr == nil || !strings.HasSuffix(*addr, fmt.Sprintf(":%d", s.Port)) {
+		t.Errorf("Expected the address to use port %d, got %v", s.Port, addr)
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("hello"), 0o644)
+
+	h, err := NewHandler(WithRoot(dir), WithAuth(NewAccessControl("secret", "tok").Check))
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	get := func(target string, prepare func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if prepare != nil {
+			prepare(req)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/file.txt", nil)
+	if w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic") {
+		t.Errorf("Expected a Basic challenge, got %d %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+
+	w = get("/file.txt", func(r *http.Request) { r.SetBasicAuth("anyone", "secret") })
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("Expected the password to be accepted, got %d", w.Code)
+	}
+
+	w = get("/file.txt", func(r *http.Request) { r.Header.Set("Authorization", "Bearer tok") })
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the bearer token to be accepted, got %d", w.Code)
+	}
+
+	// a browser trades the token in the URL for a session cookie
+	w = get("/file.txt?token=tok&download=1", func(r *http.Request) { r.Header.Set("Accept", "text/html") })
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "file.txt?download=1" {
+		t.Fatalf("Expected a redirect dropping the token, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookieName || !cookies[0].HttpOnly {
+		t.Fatalf("Expected an HttpOnly session cookie, got %v", cookies)
+	}
+
+	w = get("/file.txt", func(r *http.Request) { r.AddCookie(cookies[0]) })
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the session cookie to be accepted, got %d", w.Code)
+	}
+
+	for i := 0; i < maxAuthFailures; i++ {
+		w = get("/file.txt?token=wrong", nil)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Attempt %d: expected status 401, got %d", i+1, w.Code)
+		}
+	}
+
+	w = get("/file.txt", func(r *http.Request) { r.SetBasicAuth("anyone", "secret") })
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the client to be rate limited, got %d", w.Code)
+	}
+
+	// someone else behind the same IP keeps their session
+	w = get("/file.txt", func(r *http.Request) { r.AddCookie(cookies[0]) })
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected a session to outlast failures from its IP, got %d", w.Code)
+	}
+
+	w = get("/file.txt", func(r *http.Request) {
+		r.RemoteAddr = "192.0.2.2:1234"
+		r.SetBasicAuth("anyone", "secret")
+	})
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected other clients to be unaffected, got %d", w.Code)
+	}
+
+	mounted, err := NewHandler(WithRoot(dir), WithBasePath("/files"), WithAuth(NewAccessControl("", "tok").Check))
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	w = httptest.NewRecorder()
+	mounted.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/file.txt?token=tok", nil))
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].Path != "/files" {
+		t.Errorf("Expected the session cookie to be scoped to the base path, got %v", cookies)
+	}
+}
+
+func TestFailureLimiter_Prunes(t *testing.T) {
+	var l failureLimiter
+	for i := range 100 {
+		l.fail(fmt.Sprintf("192.0.2.%d", i))
+	}
+	for _, f := range l.failures {
+		f.since = f.since.Add(-2 * authFailureWindow)
+	}
+
+	l.fail("192.0.2.200")
+	if len(l.failures) != 1 {
+		t.Errorf("Expected old failures to be forgotten, %d are left", len(l.failures))
+	}
+}
+
+func TestHandler_Approvals(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("hello"), 0o644)
+
+	approvals := NewApprovals()
+	ch := make(chan ServerEvent, 100)
+	h := newEventHandler(t, dir, ch, WithApprovals(approvals))
+
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("User-Agent", "curl/8.5.0")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := get("192.0.2.1:1234")
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+			t.Errorf("Expected a pending client to wait, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), `http-equiv="refresh"`) {
+			t.Error("Expected the waiting page to refresh itself")
+		}
+	}
+
+	var requests []EventApprovalRequest
+	for len(ch) > 0 {
+		if e, ok := (<-ch).(EventApprovalRequest); ok {
+			requests = append(requests, e)
+		}
+	}
+	if len(requests) != 1 || requests[0].Client.IP != "192.0.2.1" || requests[0].Client.Device != "curl" {
+		t.Errorf("Expected one approval request for 192.0.2.1, got %+v", requests)
+	}
+
+	pending := approvals.Pending()
+	if len(pending) != 1 || pending[0].IP != "192.0.2.1" {
+		t.Fatalf("Expected 192.0.2.1 to be pending, got %+v", pending)
+	}
+
+	approvals.Approve("192.0.2.1")
+	if w := get("192.0.2.1:1234"); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("Expected an approved client to get the file, got %d", w.Code)
+	}
+
+	get("192.0.2.2:1234")
+	approvals.Deny("192.0.2.2")
+	if w := get("192.0.2.2:1234"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a denied client to get 403, got %d", w.Code)
+	}
+
+	if w := get("127.0.0.1:1234"); w.Code != http.StatusOK {
+		t.Errorf("Expected the local machine to be let in, got %d", w.Code)
+	}
+
+	if err := approvals.Approve("192.0.2.9"); !errors.Is(err, ErrUnknownClient) {
+		t.Errorf("Expected ErrUnknownClient, got %v", err)
+	}
+
+	// strangers without the token don't get to ask
+	guarded := newEventHandler(t, dir, ch, WithApprovals(approvals), WithAuth(NewAccessControl("", "tok").Check))
+	req := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+	req.RemoteAddr = "192.0.2.3:1234"
+	w := httptest.NewRecorder()
+	guarded.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized || len(approvals.Pending()) != 0 {
+		t.Errorf("Expected an unauthenticated client to be turned away unseen, got %d %+v", w.Code, approvals.Pending())
+	}
+}
+
+func TestApprovals_Bounded(t *testing.T) {
+	approvals := NewApprovals()
+	for i := range maxPendingApprovals + 5 {
+		approvals.check(&Client{IP: fmt.Sprintf("192.0.2.%d", i)})
+	}
+	if n := len(approvals.Pending()); n != maxPendingApprovals {
+		t.Fatalf("Expected %d clients to wait, got %d", maxPendingApprovals, n)
+	}
+
+	// clients that stopped checking back make room
+	approvals.clients["192.0.2.0"].lastSeen = time.Now().Add(-2 * approvalStaleAfter)
+	if _, isNew := approvals.check(&Client{IP: "192.0.2.100"}); !isNew {
+		t.Error("Expected a stale client to make room")
+	}
+	if err := approvals.Approve("192.0.2.0"); !errors.Is(err, ErrUnknownClient) {
+		t.Errorf("Expected the stale client to be forgotten, got %v", err)
+	}
+
+	for ip := range approvals.clients {
+		approvals.Deny(ip)
+	}
+	for i := range maxApprovals {
+		if i%maxPendingApprovals == 0 {
+			for ip, ap := range approvals.clients {
+				if ap.status == approvalPending {
+					approvals.Deny(ip)
+				}
+			}
+		}
+		approvals.check(&Client{IP: fmt.Sprintf("198.51.%d.%d", i/256, i%256)})
+	}
+	if len(approvals.clients) > maxApprovals {
+		t.Errorf("Expected at most %d known clients, got %d", maxApprovals, len(approvals.clients))
+	}
+}
+
+func TestHandler_Shares(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0o644)
+	os.MkdirAll(filepath.Join(dir, "public", "nested"), 0o755)
+	os.WriteFile(filepath.Join(dir, "public", "a.txt"), []byte("aaa"), 0o644)
+	os.WriteFile(filepath.Join(dir, "public", "nested", "b.txt"), []byte("bbb"), 0o644)
+	os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(dir, "public", "link.txt"))
+
+	shareDir := filepath.Join(t.TempDir(), "shares")
+	shares := newSharesAt(shareDir)
+
+	ch := make(chan ServerEvent)
+	t.Cleanup(func() { close(ch) })
+	go func() {
+		for range ch {
+		}
+	}()
+	h := newEventHandler(t, dir, ch,
+		WithUpload(true),
+		WithAuth(NewAccessControl("", "token").Check),
+		WithApprovals(NewApprovals()),
+		WithShares(shares))
+
+	getFrom := func(ip, link string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, link, nil)
+		req.RemoteAddr = ip + ":1234"
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	get := func(link string, header ...string) *httptest.ResponseRecorder {
+		return getFrom("192.0.2.1", link, header...)
+	}
+	link := func(urlPath string, opts ShareOptions) string {
+		_, token, err := shares.Create(urlPath, opts)
+		if err != nil {
+			t.Fatalf("Failed to create share: %v", err)
+		}
+		return ShareURL("", token)
+	}
+
+	if w := get("/secret.txt"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the rest of the server to stay closed, got %d", w.Code)
+	}
+	if w := get(sharePath + "e30.AAAA/"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 before any link was made, got %d", w.Code)
+	}
+	if _, err := os.Stat(shareDir); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected nothing to be written before the first link, got %v", err)
+	}
+
+	file := link("/public/a.txt", ShareOptions{MaxDownloads: 2})
+	for i := 0; i < 2; i++ {
+		if w := get(file); w.Code != http.StatusOK || w.Body.String() != "aaa" {
+			t.Errorf("Expected the shared file, got %d %q", w.Code, w.Body.String())
+		}
+	}
+	if w := get(file); w.Code != http.StatusGone {
+		t.Errorf("Expected 410 once the downloads are used up, got %d", w.Code)
+	}
+
+	// a range request counts unless it continues a counted download of the
+	// same client, which may even be finished once the link is used up
+	ranged := link("/public/a.txt", ShareOptions{MaxDownloads: 1})
+	if w := get(ranged, "Range", "bytes=1-"); w.Code != http.StatusPartialContent || w.Body.String() != "aa" {
+		t.Errorf("Expected the rest of the file, got %d %q", w.Code, w.Body.String())
+	}
+	if w := get(ranged, "Range", "bytes=0-0"); w.Code != http.StatusPartialContent || w.Body.String() != "a" {
+		t.Errorf("Expected the download to be resumed, got %d %q", w.Code, w.Body.String())
+	}
+	if w := get(ranged); w.Code != http.StatusGone {
+		t.Errorf("Expected a new download to count, got %d", w.Code)
+	}
+	for _, rng := range []string{"bytes=1-", "bytes=-100000000", "bytes=1-,0-0"} {
+		if w := getFrom("192.0.2.2", ranged, "Range", rng); w.Code != http.StatusGone {
+			t.Errorf("Expected %s from another client to count as a download, got %d", rng, w.Code)
+		}
+	}
+	if w := get(link("/public/a.txt", ShareOptions{MaxDownloads: 1}), "Range", "bytes=1-", "If-Range", `"stale"`); w.Code != http.StatusOK {
+		t.Errorf("Expected a stale If-Range to send the whole file, got %d", w.Code)
+	}
+
+	if w := get(link("/public/a.txt", ShareOptions{}) + "/../../secret.txt"); w.Code == http.StatusOK {
+		t.Errorf("Expected a file link to reach nothing else, got %d", w.Code)
+	}
+
+	folder := link("/public", ShareOptions{})
+	if w := get(folder+"/", "User-Agent", "Mozilla/5.0"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "a.txt") {
+		t.Errorf("Expected the folder listing, got %d", w.Code)
+	}
+	if w := get(folder + "/nested/b.txt"); w.Code != http.StatusOK || w.Body.String() != "bbb" {
+		t.Errorf("Expected a file in the shared folder, got %d %q", w.Code, w.Body.String())
+	}
+	for _, escape := range []string{"/../secret.txt", "/%2e%2e/secret.txt", "/link.txt"} {
+		if w := get(folder + escape); w.Code == http.StatusOK {
+			t.Errorf("Expected %s to stay out of reach, got %d %q", escape, w.Code, w.Body.String())
+		}
+	}
+	req := httptest.NewRequest(http.MethodPut, folder+"/new.txt", strings.NewReader("x"))
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected share links to be read-only, got %d", w.Code)
+	}
+
+	payload, _, _ := strings.Cut(strings.TrimPrefix(folder, sharePath), ".")
+	if w := get(sharePath + payload + ".AAAA/a.txt"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a tampered link to be rejected, got %d", w.Code)
+	}
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"id":"x","p":"/"}`))
+	if w := get(sharePath + forged + "." + strings.Split(folder, ".")[1] + "/secret.txt"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a forged link to be rejected, got %d", w.Code)
+	}
+
+	protected := link("/public/a.txt", ShareOptions{Password: "pw"})
+	if w := get(protected); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected a password prompt, got %d", w.Code)
+	}
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte(":pw"))
+	if w := get(protected, "Authorization", basic); w.Code != http.StatusOK || w.Body.String() != "aaa" {
+		t.Errorf("Expected the file with the password, got %d", w.Code)
+	}
+
+	revoked, token, _ := shares.Create("/public", ShareOptions{})
+	if err := shares.Revoke(revoked.ID); err != nil {
+		t.Fatalf("Failed to revoke: %v", err)
+	}
+	if w := get(ShareURL("", token) + "/a.txt"); w.Code != http.StatusGone {
+		t.Errorf("Expected 410 for a revoked link, got %d", w.Code)
+	}
+
+	expired, token, _ := shares.Create("/public", ShareOptions{TTL: time.Nanosecond})
+	time.Sleep(time.Second)
+	if w := get(ShareURL("", token) + "/a.txt"); w.Code != http.StatusGone {
+		t.Errorf("Expected 410 for an expired link %s, got %d", expired.ID, w.Code)
+	}
+
+	list, err := shares.List()
+	if err != nil || len(list) != 8 {
+		t.Fatalf("Expected 8 links, got %d, %v", len(list), err)
+	}
+	if i := slices.IndexFunc(list, func(s Share) bool { return s.MaxDownloads == 2 }); i < 0 || list[i].Downloads != 2 || list[i].Active() {
+		t.Errorf("Expected the used up link to count 2 downloads, got %+v", list)
+	}
+}
+
+func TestHandler_IPPolicy(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("hello"), 0o644)
+
+	policy, err := NewIPPolicy(DefaultAllowedNetworks, []string{"192.168.66.0/24", "10.1.2.3"})
+	if err != nil {
+		t.Fatalf("Failed to create policy: %v", err)
+	}
+	ch := make(chan ServerEvent, 100)
+	h := newEventHandler(t, dir, ch, WithIPPolicy(policy))
+
+	get := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	tests := []struct {
+		remoteAddr string
+		want       int
+	}{
+		{"192.168.1.5:1234", http.StatusOK},
+		{"10.0.0.1:1234", http.StatusOK},
+		{"172.20.0.1:1234", http.StatusOK},
+		{"127.0.0.1:1234", http.StatusOK},
+		{"[::1]:1234", http.StatusOK},
+		{"[fe80::1%eth0]:1234", http.StatusOK},
+		{"[::ffff:192.168.1.5]:1234", http.StatusOK},
+		{"203.0.113.1:1234", http.StatusForbidden},
+		{"[2001:db8::1]:1234", http.StatusForbidden},
+		{"172.32.0.1:1234", http.StatusForbidden},
+		{"192.168.66.7:1234", http.StatusForbidden},
+		{"10.1.2.3:1234", http.StatusForbidden},
+		{"not an address", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if got := get(tt.remoteAddr); got != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.remoteAddr, tt.want, got)
+		}
+	}
+
+	for len(ch) > 0 {
+		if e, ok := (<-ch).(EventConnOpen); ok && !policy.Allowed(e.Client.IP) {
+			t.Errorf("Expected rejected clients to open no connection, got %s", e.Client.IP)
+		}
+	}
+
+	if err := policy.Ban("192.168.1.5"); err != nil {
+		t.Fatalf("Failed to ban: %v", err)
+	}
+	if got := get("192.168.1.5:1234"); got != http.StatusForbidden {
+		t.Errorf("Expected a banned IP to get 403, got %d", got)
+	}
+	if got := get("[::ffff:192.168.1.5]:1234"); got != http.StatusForbidden {
+		t.Errorf("Expected a banned IP to get 403 over IPv6, got %d", got)
+	}
+	if banned := policy.Banned(); !slices.Equal(banned, []string{"192.168.1.5"}) {
+		t.Errorf("Expected 192.168.1.5 to be banned, got %v", banned)
+	}
+	policy.Unban("192.168.1.5")
+	if got := get("192.168.1.5:1234"); got != http.StatusOK {
+		t.Errorf("Expected an unbanned IP to be let in, got %d", got)
+	}
+
+	if err := policy.Ban("nope"); !errors.Is(err, ErrInvalidIP) {
+		t.Errorf("Expected ErrInvalidIP, got %v", err)
+	}
+	if _, err := NewIPPolicy([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("Expected an invalid network to be rejected")
+	}
+
+	open, _ := NewIPPolicy(nil, nil)
+	if !open.Allowed("203.0.113.1") {
+		t.Error("Expected a policy without allowed networks to let everyone in")
+	}
+}
+
+func TestServer_BanCutsConnections(t *testing.T) {
+	dir := t.TempDir()
+	f, _ := os.Create(filepath.Join(dir, "big.bin"))
+	f.Truncate(64 * 1024 * 1024)
+	f.Close()
+
+	s, err := NewServer(dir, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go s.Serve()
+	defer s.Close()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/big.bin", s.Port)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to GET file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if err := s.Ban("127.0.0.1"); err != nil {
+		t.Fatalf("Failed to ban: %v", err)
+	}
+
+	if n, err := io.Copy(io.Discard, resp.Body); err == nil {
+		t.Errorf("Expected the transfer to be cut off, got all %d bytes", n)
+	}
+
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to GET file: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a banned client to get 403, got %d", resp.StatusCode)
+	}
+}
+
+func TestServer_CloseStopsTrashPurge(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewServer(dir, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	trash, err := newTrashAt(t.TempDir(), dir, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create trash: %v", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.purgeTrash(trash)
+		close(stopped)
+	}()
+
+	s.Close()
+	s.Close()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Close to stop purging the trash")
+	}
+}
+
+func TestServer_StateReadableWhileStarting(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	s, err := NewServer(t.TempDir(), 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	s.Upload = true
+	s.RequireApproval = true
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer s.Close()
+
+	// the UI renders while the server starts up
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				s.PendingClients()
+				s.Shares()
+				s.TrashEntries()
+			}
+		}()
+	}
+
+	go s.Serve()
+	for !s.GetState().Upload {
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+
+	if _, err := s.TrashEntries(); err != nil {
+		t.Errorf("Failed to list the trash: %v", err)
+	}
+}
+
+func TestServer_TLS(t *testing.T) {
+	certDir := t.TempDir()
+	cert, err := selfSignedCertificateAt(certDir)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	if _, ok := leaf.PublicKey.(*ecdsa.PublicKey); !ok {
+		t.Errorf("Expected an ECDSA key, got %T", leaf.PublicKey)
+	}
+	for _, host := range []string{"localhost", "127.0.0.1"} {
+		if err := leaf.VerifyHostname(host); err != nil {
+			t.Errorf("Expected the certificate to cover %s: %v", host, err)
+		}
+	}
+
+	cached, err := selfSignedCertificateAt(certDir)
+	if err != nil || Fingerprint(cached) != Fingerprint(cert) {
+		t.Errorf("Expected the cached certificate to be reused, got %v", err)
+	}
+	if fp := Fingerprint(cert); len(fp) != 32*3-1 || !strings.HasPrefix(fp, ShortFingerprint(cert)+":") {
+		t.Errorf("Unexpected fingerprint %q, short %q", fp, ShortFingerprint(cert))
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("hello"), 0o644)
+
+	s, err := NewServer(dir, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	s.TLS = true
+	s.TLSCert = filepath.Join(certDir, certFile)
+	s.TLSKey = filepath.Join(certDir, keyFile)
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go s.Serve()
+	defer s.Close()
+
+	state := s.GetState()
+	if state.Fingerprint != Fingerprint(cert) {
+		t.Errorf("Expected the state to carry the fingerprint, got %q", state.Fingerprint)
+	}
+	if !strings.HasPrefix(*state.Addr, "https://") || !strings.HasSuffix(*state.Addr, "/#fp="+ShortFingerprint(cert)) {
+		t.Errorf("Expected an https URL with the short fingerprint, got %s", *state.Addr)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/file.txt", s.Port))
+	if err != nil {
+		t.Fatalf("Failed to GET over TLS: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("Expected the file over TLS, got %d %q", resp.StatusCode, body)
+	}
+
+	other, _ := NewServer(dir, 0, nil)
+	other.TLS, other.TLSCert, other.TLSKey = true, s.TLSCert, filepath.Join(certDir, "missing.pem")
+	if err := other.Listen(); err == nil {
+		t.Error("Expected a missing key file to fail Listen")
+	}
+}
@@ -0,0 +1,601 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.sakib.dev/le/pkg/nanoid"
+	"go.sakib.dev/le/pkg/utils"
+)
+
+const (
+	DefaultShareTTL = 24 * time.Hour
+
+	sharePath     = internalPrefix + "share/"
+	shareKeyFile  = "key"
+	shareListFile = "shares.json"
+
+	// range requests for a file a client is already downloading from a link
+	// aren't counted again until they stop for shareResumeWindow
+	shareResumeWindow = 10 * time.Minute
+)
+
+var (
+	ErrShareNotFound = errors.New("share link not found")
+	ErrShareExpired  = errors.New("share link expired")
+	ErrShareRevoked  = errors.New("share link revoked")
+	ErrShareUsedUp   = errors.New("share link has no downloads left")
+)
+
+// Share is a link to a single file or folder that works without the access
+// control of the rest of the server.
+type Share struct {
+	ID           string
+	Path         string // URL path of the shared file or folder
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+	MaxDownloads int // 0 means unlimited
+	Downloads    int
+	PasswordHash string `json:",omitempty"`
+	Revoked      bool
+}
+
+func (s Share) HasPassword() bool {
+	return s.PasswordHash != ""
+}
+
+// Active reports whether the link can still be used.
+func (s Share) Active() bool {
+	return s.err() == nil
+}
+
+func (s Share) err() error {
+	switch {
+	case s.Revoked:
+		return ErrShareRevoked
+	case !time.Now().Before(s.ExpiresAt):
+		return ErrShareExpired
+	case s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads:
+		return ErrShareUsedUp
+	}
+	return nil
+}
+
+// ShareOptions limit a share link. A zero TTL means DefaultShareTTL.
+type ShareOptions struct {
+	TTL          time.Duration
+	MaxDownloads int
+	Password     string
+}
+
+// Shares mints and checks share links for a served directory. Links are
+// signed with a key kept outside the served tree, next to a list of all links
+// with their download counts. Both are files, so links created by another
+// process, e.g. `le share`, work right away. Nothing is written before the
+// first link is created.
+type Shares struct {
+	dir     string
+	mu      sync.Mutex // guards the list of links
+	keyMu   sync.Mutex
+	key     []byte // loaded on first use, guarded by keyMu
+	limiter failureLimiter
+
+	resumeMu sync.Mutex
+	resumes  map[shareDownload]time.Time // counted downloads to when they may be resumed
+}
+
+// shareDownload is a file a client downloads through a link.
+type shareDownload struct {
+	id, ip, path string
+}
+
+// shareClaims is the signed part of a link.
+type shareClaims struct {
+	ID      string `json:"id"`
+	Path    string `json:"p"`
+	Expires int64  `json:"e"`
+	Max     int    `json:"m,omitempty"`
+}
+
+// NewShares returns the share links of the served directory root.
+func NewShares(root string) *Shares {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+
+	sum := sha256.Sum256([]byte(root))
+	return newSharesAt(filepath.Join(base, "le", "shares", hex.EncodeToString(sum[:6])))
+}
+
+func newSharesAt(dir string) *Shares {
+	return &Shares{dir: dir}
+}
+
+// signingKey returns the key links are signed with. It is created along with
+// the share directory if create is set, otherwise a missing key is reported
+// as fs.ErrNotExist.
+func (s *Shares) signingKey(create bool) ([]byte, error) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+
+	if s.key != nil {
+		return s.key, nil
+	}
+
+	keyPath := filepath.Join(s.dir, shareKeyFile)
+	key, err := os.ReadFile(keyPath)
+	if errors.Is(err, fs.ErrNotExist) && create {
+		if err := os.MkdirAll(s.dir, 0o700); err != nil {
+			return nil, fmt.Errorf("error creating share directory: %w", err)
+		}
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(keyPath, key, 0o600); err != nil {
+			return nil, fmt.Errorf("error writing share key: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading share key: %w", err)
+	}
+
+	s.key = key
+	return key, nil
+}
+
+// Create mints a link for urlPath and returns it with its token.
+func (s *Shares) Create(urlPath string, opts ShareOptions) (Share, string, error) {
+	key, err := s.signingKey(true)
+	if err != nil {
+		return Share{}, "", err
+	}
+
+	ttl := opts.TTL
+	if ttl <= 0 {
+		ttl = DefaultShareTTL
+	}
+
+	now := time.Now()
+	share := Share{
+		ID:           nanoid.NewWithLen(10),
+		Path:         path.Clean("/" + urlPath),
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(ttl).Truncate(time.Second),
+		MaxDownloads: max(opts.MaxDownloads, 0),
+	}
+	if opts.Password != "" {
+		share.PasswordHash = hashSharePassword(key, share.ID, opts.Password)
+	}
+
+	err = s.update(func(shares []Share) ([]Share, error) {
+		return append(shares, share), nil
+	})
+	if err != nil {
+		return Share{}, "", err
+	}
+
+	return share, shareToken(key, share), nil
+}
+
+// ShareURL returns the link for token on the server at baseURL, e.g.
+// "http://192.168.1.2:8080".
+func ShareURL(baseURL, token string) string {
+	return strings.TrimSuffix(baseURL, "/") + sharePath + token
+}
+
+// shareToken returns the token of a link signed with key.
+func shareToken(key []byte, share Share) string {
+	payload, _ := json.Marshal(shareClaims{
+		ID:      share.ID,
+		Path:    share.Path,
+		Expires: share.ExpiresAt.Unix(),
+		Max:     share.MaxDownloads,
+	})
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(sign(key, encoded))
+}
+
+func sign(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func hashSharePassword(key []byte, id, password string) string {
+	return hex.EncodeToString(sign(key, "password:"+id+":"+password))
+}
+
+// List returns all links, the newest first.
+func (s *Shares) List() ([]Share, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shares, err := s.load()
+	slices.SortFunc(shares, func(a, b Share) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return shares, err
+}
+
+// Revoke disables the link with id for good.
+func (s *Shares) Revoke(id string) error {
+	return s.update(func(shares []Share) ([]Share, error) {
+		i := slices.IndexFunc(shares, func(share Share) bool { return share.ID == id })
+		if i < 0 {
+			return nil, ErrShareNotFound
+		}
+		shares[i].Revoked = true
+		return shares, nil
+	})
+}
+
+// verify checks the signature of token and returns its link if it may be
+// used. Tokens that weren't minted with the key are reported as not found.
+func (s *Shares) verify(token string) (Share, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return Share{}, ErrShareNotFound
+	}
+
+	// without a key no link was ever made
+	key, err := s.signingKey(false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Share{}, ErrShareNotFound
+	} else if err != nil {
+		return Share{}, err
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, sign(key, payload)) {
+		return Share{}, ErrShareNotFound
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Share{}, ErrShareNotFound
+	}
+	var claims shareClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return Share{}, ErrShareNotFound
+	}
+
+	if time.Now().Unix() >= claims.Expires {
+		return Share{}, ErrShareExpired
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shares, err := s.load()
+	if err != nil {
+		return Share{}, err
+	}
+
+	i := slices.IndexFunc(shares, func(share Share) bool { return share.ID == claims.ID })
+	if i < 0 || shares[i].Path != claims.Path {
+		return Share{}, ErrShareNotFound
+	}
+
+	return shares[i], shares[i].err()
+}
+
+func (s *Shares) checkPassword(share Share, password string) bool {
+	key, err := s.signingKey(false)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(share.PasswordHash), []byte(hashSharePassword(key, share.ID, password)))
+}
+
+// use counts a download of the link with id.
+func (s *Shares) use(id string) error {
+	return s.update(func(shares []Share) ([]Share, error) {
+		i := slices.IndexFunc(shares, func(share Share) bool { return share.ID == id })
+		if i < 0 {
+			return nil, ErrShareNotFound
+		}
+		if err := shares[i].err(); err != nil {
+			return nil, err
+		}
+		shares[i].Downloads++
+		return shares, nil
+	})
+}
+
+// download records that the counted download d may be resumed.
+func (s *Shares) download(d shareDownload) {
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+
+	now := time.Now()
+	for other, until := range s.resumes {
+		if now.After(until) {
+			delete(s.resumes, other)
+		}
+	}
+
+	if s.resumes == nil {
+		s.resumes = make(map[shareDownload]time.Time)
+	}
+	s.resumes[d] = now.Add(shareResumeWindow)
+}
+
+// resume reports whether d continues a counted download, which then may be
+// resumed for longer.
+func (s *Shares) resume(d shareDownload) bool {
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+
+	until, ok := s.resumes[d]
+	if !ok || time.Now().After(until) {
+		return false
+	}
+	s.resumes[d] = time.Now().Add(shareResumeWindow)
+	return true
+}
+
+// update changes the list of links, reading it first so that changes of
+// other processes aren't lost.
+func (s *Shares) update(change func([]Share) ([]Share, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shares, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	shares, err = change(shares)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(shares, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// replace the list in one go, a reader never sees half of it
+	tmp, err := os.CreateTemp(s.dir, shareListFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, shareListFile))
+}
+
+// load reads the list of links. The caller must hold mu.
+func (s *Shares) load() ([]Share, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, shareListFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var shares []Share
+	if err := json.Unmarshal(data, &shares); err != nil {
+		return nil, fmt.Errorf("error reading share links: %w", err)
+	}
+	return shares, nil
+}
+
+// serveShare serves a share link. The link is all the authorization needed,
+// so it is checked before approvals and auth, but only reaches the shared
+// file or what is inside the shared folder.
+func (h handler) serveShare(reqHelper *reqHelper) {
+	w, r := reqHelper.w, reqHelper.r
+
+	token, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, sharePath), "/")
+
+	// a used up link may still finish the downloads it counted
+	share, err := h.shares.verify(token)
+	usedUp := errors.Is(err, ErrShareUsedUp)
+	if errors.Is(err, ErrShareNotFound) {
+		reqHelper.error("NOT FOUND", err, http.StatusNotFound)
+		return
+	} else if errors.Is(err, ErrShareExpired) || errors.Is(err, ErrShareRevoked) {
+		reqHelper.error("This link is no longer valid", err, http.StatusGone)
+		return
+	} else if err != nil && !usedUp {
+		reqHelper.internalServerError(err)
+		return
+	}
+
+	if share.HasPassword() && !h.checkSharePassword(reqHelper, share) {
+		return
+	}
+
+	hh, target, err := h.shareHandler(share, token, sub)
+	if errors.Is(err, utils.ErrForbiddenPath) {
+		reqHelper.error("FORBIDDEN", err, http.StatusForbidden)
+		return
+	} else if errors.Is(err, fs.ErrNotExist) {
+		reqHelper.error("NOT FOUND", err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		reqHelper.internalServerError(err)
+		return
+	}
+	if target == "/" && !strings.HasSuffix(r.URL.Path, "/") {
+		// relative links in the listing need the slash
+		w.Header().Set("Location", token+"/")
+		w.WriteHeader(http.StatusMovedPermanently)
+		return
+	}
+	reqHelper.r = stripBasePath(r, target)
+
+	selection := "/"+sub == zipPath
+	switch {
+	case selection && r.Method == http.MethodPost:
+	case !selection && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+	default:
+		w.Header().Set("Allow", "GET, HEAD")
+		reqHelper.error("Method Not Allowed", nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip, err := utils.GetClientIP(r)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	download := shareDownload{id: share.ID, ip: ip, path: target}
+
+	isDownload, isRange := selection, false
+	if !selection {
+		isDownload, isRange = hh.isDownload(reqHelper.r)
+	}
+
+	switch {
+	case isRange && h.shares.resume(download):
+		// the rest of a download that was counted
+	case usedUp:
+		reqHelper.error("This link is no longer valid", ErrShareUsedUp, http.StatusGone)
+		return
+	case isDownload:
+		if err := h.shares.use(share.ID); err != nil {
+			reqHelper.error("This link is no longer valid", err, http.StatusGone)
+			return
+		}
+		if !selection {
+			h.shares.download(download)
+		}
+	}
+
+	reqHelper.log.InfoContext(reqHelper.ctx, "SHARE", "id", share.ID, "share", share.Path, "path", target)
+
+	if selection {
+		hh.serveSelectionArchive(reqHelper)
+		return
+	}
+	hh.serveRead(reqHelper)
+}
+
+func (h handler) checkSharePassword(reqHelper *reqHelper, share Share) bool {
+	ip, err := utils.GetClientIP(reqHelper.r)
+	if err != nil {
+		ip = reqHelper.r.RemoteAddr
+	}
+
+	if h.shares.limiter.reject(reqHelper.w, ip) {
+		return false
+	}
+
+	_, password, ok := reqHelper.r.BasicAuth()
+	if ok && h.shares.checkPassword(share, password) {
+		return true
+	}
+	if ok {
+		h.shares.limiter.fail(ip)
+	}
+
+	reqHelper.w.Header().Set("WWW-Authenticate", `Basic realm="le share", charset="UTF-8"`)
+	reqHelper.error("Unauthorized", nil, http.StatusUnauthorized)
+	return false
+}
+
+// shareHandler returns a read-only handler that sees nothing but the shared
+// file or folder, together with the path to request from it. sub is the path
+// below the link, a file link has none.
+func (h handler) shareHandler(share Share, token, sub string) (handler, string, error) {
+	name, err := h.readable(share.Path)
+	if err != nil {
+		return handler{}, "", err
+	}
+
+	info, err := fs.Stat(h.fsys, name)
+	if err != nil {
+		return handler{}, "", err
+	}
+
+	dir, target := name, "/"+sub
+	if !info.IsDir() {
+		if sub != "" {
+			return handler{}, "", utils.ErrForbiddenPath
+		}
+		dir, target = path.Dir(name), "/"+path.Base(name)
+	}
+
+	hh := h
+	hh.upload = false
+	hh.tus = nil
+	hh.trash = nil
+	hh.auth = nil
+	hh.approvals = nil
+	hh.shares = nil
+	hh.wfs = nil
+	hh.basePath = h.url(sharePath + token)
+
+	if h.root != "" && !h.inArchive(dir) {
+		// a fresh root keeps symlinks from leading out of the share
+		resolved, err := h.resolve("/" + dir)
+		if err != nil {
+			return handler{}, "", err
+		}
+		absDir := h.osPath(resolved)
+		hh.root = absDir
+		hh.fsys = archiveFS{DirFS(absDir)}
+	} else {
+		sub, err := fs.Sub(h.fsys, dir)
+		if err != nil {
+			return handler{}, "", err
+		}
+		hh.root = ""
+		hh.fsys = sub
+	}
+	hh.defaultServer = newDefaultServer(&hh)
+
+	return hh, target, nil
+}
+
+// isDownload reports whether r fetches a file or archive rather than a
+// listing, and whether it asks for a range that could continue a download of
+// the same file.
+func (h handler) isDownload(r *http.Request) (isDownload, isRange bool) {
+	if r.Method != http.MethodGet {
+		return false, false
+	}
+	if r.URL.Query().Get("archive") != "" {
+		return true, false
+	}
+
+	file, err := h.fsys.Open(fsName(r.URL.Path))
+	if err != nil {
+		return false, false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		return false, false
+	}
+
+	_, seekable := file.(io.Seeker)
+	return true, seekable && r.Header.Get("Range") != "" && ifRangeMatches(r, info)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"slices"
+	"sync"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind before
+// events for it are dropped.
+const subscriberBuffer = 64
+
+// EventFilter selects the events a subscriber receives. A nil filter selects
+// all events.
+type EventFilter func(ServerEvent) bool
+
+// EventNames returns a filter that selects events with any of the given names.
+func EventNames(names ...ServerEventName) EventFilter {
+	return func(e ServerEvent) bool {
+		return slices.Contains(names, e.EventName())
+	}
+}
+
+type subscriber struct {
+	ch      chan ServerEvent
+	filter  EventFilter
+	dropped int64
+}
+
+// Subscribe returns a channel receiving every event that passes filter. Each
+// subscriber gets its own buffered channel; events for a subscriber that
+// doesn't keep up are dropped so it can never slow down the server. cancel
+// stops the subscription and closes the channel, it may be called more than
+// once.
+func (s *Server) Subscribe(filter EventFilter) (<-chan ServerEvent, func()) {
+	sub := &subscriber{
+		ch:     make(chan ServerEvent, subscriberBuffer),
+		filter: filter,
+	}
+
+	s.subsMu.Lock()
+	if s.subs == nil {
+		s.subs = make(map[*subscriber]struct{})
+	}
+	s.subs[sub] = struct{}{}
+	s.subsMu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			s.subsMu.Lock()
+			delete(s.subs, sub)
+			s.subsMu.Unlock()
+			close(sub.ch)
+		})
+	}
+
+	return sub.ch, cancel
+}
+
+// broadcast hands event to all interested subscribers without blocking.
+func (s *Server) broadcast(event ServerEvent) {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+
+	for sub := range s.subs {
+		if sub.filter != nil && !sub.filter(event) {
+			continue
+		}
+
+		select {
+		case sub.ch <- event:
+		default:
+			sub.dropped++
+			s.logger().Debug("Dropped event for lagging subscriber", "event", event.EventName(), "dropped", sub.dropped)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.sakib.dev/le/pkg/utils"
+)
+
+const (
+	certFile = "cert.pem"
+	keyFile  = "key.pem"
+
+	certLifetime = 365 * 24 * time.Hour
+	// a cached certificate this close to expiring is replaced
+	certRenewBefore = 7 * 24 * time.Hour
+
+	// shortFingerprintLen is how many bytes of the fingerprint go into the
+	// URL of the QR code.
+	shortFingerprintLen = 8
+)
+
+// LoadCertificate loads a certificate and its key from PEM files.
+func LoadCertificate(certPath, keyPath string) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error loading certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// SelfSignedCertificate returns a self-signed certificate for the local IPs
+// and the host name. It is cached under the user config directory, so
+// browsers that trusted it once keep doing so, and only replaced when it
+// expires or the machine got an address it doesn't cover.
+func SelfSignedCertificate() (tls.Certificate, error) {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return selfSignedCertificateAt(filepath.Join(base, "le", "tls"))
+}
+
+func selfSignedCertificateAt(dir string) (tls.Certificate, error) {
+	hosts := certHosts()
+
+	certPath, keyPath := filepath.Join(dir, certFile), filepath.Join(dir, keyFile)
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil && certCovers(cert, hosts) {
+		return cert, nil
+	}
+
+	certPEM, keyPEM, err := generateCertificate(hosts)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error generating certificate: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return tls.Certificate{}, fmt.Errorf("error creating certificate directory: %w", err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		return tls.Certificate{}, fmt.Errorf("error writing key: %w", err)
+	}
+	if err := os.WriteFile(certPath, certPEM, 0o644); err != nil {
+		return tls.Certificate{}, fmt.Errorf("error writing certificate: %w", err)
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// certHosts returns the names the certificate has to be valid for.
+func certHosts() []string {
+	hosts := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname)
+	}
+
+	ips, err := utils.GetLocalIPs()
+	if err != nil {
+		ips = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	for _, ip := range ips {
+		// link-local addresses need a zone, which a certificate can't name
+		if !ip.IsLinkLocalUnicast() {
+			hosts = append(hosts, ip.String())
+		}
+	}
+	return hosts
+}
+
+// certCovers reports whether cert is valid for all hosts for a while longer.
+func certCovers(cert tls.Certificate, hosts []string) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || time.Now().Add(certRenewBefore).After(leaf.NotAfter) {
+		return false
+	}
+	for _, host := range hosts {
+		if leaf.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func generateCertificate(hosts []string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"le"}, CommonName: "le"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of cert the way browsers show
+// it, e.g. "AB:12:...".
+func Fingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return formatFingerprint(sum[:])
+}
+
+// ShortFingerprint returns the start of the fingerprint, enough to tell
+// certificates apart at a glance.
+func ShortFingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return formatFingerprint(sum[:shortFingerprintLen])
+}
+
+func formatFingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// sendChunkSize is how much is handed to the kernel in one go. Progress is
+// published after every chunk, so it also bounds how stale progress can get.
+const sendChunkSize = 4 * 1024 * 1024
+
+// progressWriter counts everything written through it, publishes download
+// progress and logs the transfer rate every downloadProgressLogInterval.
+//
+// It implements io.ReaderFrom so that copying a file into it still reaches
+// the ReadFrom of the http.ResponseWriter, which lets the kernel send the file
+// straight from the page cache.
+type progressWriter struct {
+	w         io.Writer
+	reqHelper *reqHelper
+	fileName  string
+	total     int64 // expected number of bytes, -1 if unknown
+	sent      int64
+
+	lastReportedSent int64
+	lastReportedTime time.Time
+}
+
+func newProgressWriter(w io.Writer, reqHelper *reqHelper, fileName string, total int64) *progressWriter {
+	return &progressWriter{
+		w:                w,
+		reqHelper:        reqHelper,
+		fileName:         fileName,
+		total:            total,
+		lastReportedTime: time.Now(),
+	}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.add(int64(n))
+	return n, err
+}
+
+// ReadFrom copies r in chunks of sendChunkSize. A *io.LimitedReader is
+// unwrapped first, the network stack only recognises a file directly inside
+// a single LimitedReader.
+func (p *progressWriter) ReadFrom(r io.Reader) (int64, error) {
+	src, remaining := r, int64(-1)
+	lr, limited := r.(*io.LimitedReader)
+	if limited {
+		src, remaining = lr.R, lr.N
+	}
+
+	var written int64
+	var err error
+	for remaining != 0 {
+		chunk := int64(sendChunkSize)
+		if remaining > 0 && remaining < chunk {
+			chunk = remaining
+		}
+
+		var n int64
+		n, err = io.Copy(p.w, io.LimitReader(src, chunk))
+		written += n
+		if remaining > 0 {
+			remaining -= n
+		}
+		p.add(n)
+
+		if err != nil || n < chunk {
+			break
+		}
+	}
+
+	if limited {
+		lr.N -= written
+	}
+
+	return written, err
+}
+
+func (p *progressWriter) add(n int64) {
+	if n <= 0 {
+		return
+	}
+
+	p.sent += n
+	p.reqHelper.publishDownloadProgress(int(n))
+
+	if time.Since(p.lastReportedTime) <= downloadProgressLogInterval {
+		return
+	}
+
+	totalMBSent := float64(p.sent) / 1024 / 1024
+	mbps := float64(p.sent-p.lastReportedSent) / 1024 / 1024 / time.Since(p.lastReportedTime).Seconds()
+
+	if p.total > 0 {
+		progress := float64(p.sent) / float64(p.total) * 100
+		msg := fmt.Sprintf("%7.2f / %7.2f MB sent | %2.2f%% | %5.2f MB/s",
+			totalMBSent, float64(p.total)/1024/1024, progress, mbps)
+		p.reqHelper.log.InfoContext(p.reqHelper.ctx, msg, "file", p.fileName)
+	} else {
+		msg := fmt.Sprintf("%7.2f MB sent | %5.2f MB/s", totalMBSent, mbps)
+		p.reqHelper.log.InfoContext(p.reqHelper.ctx, msg, "file", p.fileName)
+	}
+
+	p.lastReportedSent = p.sent
+	p.lastReportedTime = time.Now()
+}
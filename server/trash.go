@@ -0,0 +1,314 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.sakib.dev/le/logger"
+	"go.sakib.dev/le/pkg/nanoid"
+	"go.sakib.dev/le/pkg/utils"
+)
+
+const (
+	DefaultTrashRetention = 7 * 24 * time.Hour
+
+	trashPath          = internalPrefix + "trash/"
+	trashInfoFile      = "info.json"
+	trashDataFile      = "data"
+	trashPurgeInterval = time.Hour
+)
+
+type TrashReason string
+
+const (
+	TrashReasonDelete    TrashReason = "delete"
+	TrashReasonOverwrite TrashReason = "overwrite"
+)
+
+var ErrTrashEntryNotFound = errors.New("trash entry not found")
+
+// TrashEntry describes a deleted or overwritten file kept in the trash.
+type TrashEntry struct {
+	ID        string
+	Path      string // original URL path inside the served directory
+	DeletedAt time.Time
+	Reason    TrashReason
+	IsDir     bool
+	Size      int64
+}
+
+// Name returns the base name of the original path.
+func (e TrashEntry) Name() string {
+	return path.Base(e.Path)
+}
+
+// Trash keeps deleted and overwritten entries of a served directory so they can
+// be restored. It lives outside the served tree, every entry is a directory
+// holding the original data and a JSON description.
+type Trash struct {
+	dir       string
+	root      string
+	retention time.Duration
+	mu        sync.Mutex
+}
+
+// NewTrash returns the trash for the served directory root. Entries older than
+// retention are purged.
+func NewTrash(root string, retention time.Duration) (*Trash, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+
+	sum := sha256.Sum256([]byte(root))
+	dir := filepath.Join(base, "le", "trash", hex.EncodeToString(sum[:6]))
+
+	return newTrashAt(dir, root, retention)
+}
+
+func newTrashAt(dir, root string, retention time.Duration) (*Trash, error) {
+	if dir == root || strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		return nil, fmt.Errorf("trash directory %s is inside the served directory", dir)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating trash directory: %w", err)
+	}
+
+	return &Trash{
+		dir:       dir,
+		root:      root,
+		retention: retention,
+	}, nil
+}
+
+// Put moves the entry at absPath, known to clients as urlPath, into the trash.
+func (t *Trash) Put(absPath, urlPath string, reason TrashReason) (TrashEntry, error) {
+	info, err := os.Lstat(absPath)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+
+	entry := TrashEntry{
+		ID:        fmt.Sprintf("%d-%s", time.Now().Unix(), nanoid.New()),
+		Path:      path.Clean("/" + urlPath),
+		DeletedAt: time.Now(),
+		Reason:    reason,
+		IsDir:     info.IsDir(),
+		Size:      info.Size(),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entryDir := filepath.Join(t.dir, entry.ID)
+	if err := os.Mkdir(entryDir, 0o700); err != nil {
+		return TrashEntry{}, err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	if err := os.WriteFile(filepath.Join(entryDir, trashInfoFile), data, 0o600); err != nil {
+		os.RemoveAll(entryDir)
+		return TrashEntry{}, err
+	}
+
+	if err := utils.MoveFile(absPath, filepath.Join(entryDir, trashDataFile)); err != nil {
+		os.RemoveAll(entryDir)
+		return TrashEntry{}, err
+	}
+
+	return entry, nil
+}
+
+// List returns all entries, most recently deleted first.
+func (t *Trash) List() ([]TrashEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	dirs, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []TrashEntry
+	for _, dir := range dirs {
+		entry, err := t.load(dir.Name())
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.After(entries[j].DeletedAt)
+	})
+
+	return entries, nil
+}
+
+func (t *Trash) load(id string) (TrashEntry, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return TrashEntry{}, ErrTrashEntryNotFound
+	}
+
+	data, err := os.ReadFile(filepath.Join(t.dir, id, trashInfoFile))
+	if os.IsNotExist(err) {
+		return TrashEntry{}, ErrTrashEntryNotFound
+	} else if err != nil {
+		return TrashEntry{}, err
+	}
+
+	var entry TrashEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return TrashEntry{}, err
+	}
+
+	return entry, nil
+}
+
+// Restore moves an entry back to its original location and returns it along
+// with the URL path it was restored to. Missing parent folders are recreated;
+// if the original name is taken by now a numeric suffix is added.
+func (t *Trash) Restore(id string) (TrashEntry, string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, err := t.load(id)
+	if err != nil {
+		return TrashEntry{}, "", err
+	}
+
+	dir := path.Dir(entry.Path)
+	dirPath, err := resolvePath(t.root, dir)
+	if err != nil {
+		return TrashEntry{}, "", err
+	}
+	if err := os.MkdirAll(dirPath, 0o755); err != nil {
+		return TrashEntry{}, "", err
+	}
+
+	name, err := placeFile(filepath.Join(t.dir, id, trashDataFile), t.root, dir, entry.Name())
+	if err != nil {
+		return TrashEntry{}, "", err
+	}
+
+	os.RemoveAll(filepath.Join(t.dir, id))
+
+	return entry, path.Join(dir, name), nil
+}
+
+// Purge removes entries older than the retention period and returns how many
+// were removed.
+func (t *Trash) Purge() (int, error) {
+	entries, err := t.List()
+	if err != nil {
+		return 0, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	purged := 0
+	cutoff := time.Now().Add(-t.retention)
+	for _, entry := range entries {
+		if entry.DeletedAt.After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(t.dir, entry.ID)); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+type TrashPageData struct {
+	Entries     []TrashPageEntry
+	RestorePath string
+	RootPath    string
+}
+
+type TrashPageEntry struct {
+	ID      string
+	Path    string
+	Deleted string
+	Reason  TrashReason
+	IsDir   bool
+	Size    string
+}
+
+// serveTrash handles the trash page at /.le/trash/ and restores entries posted
+// to /.le/trash/restore.
+func (h handler) serveTrash(reqHelper *reqHelper, action string) {
+	w, r := reqHelper.w, reqHelper.r
+
+	if h.trash == nil {
+		reqHelper.error("NOT FOUND", nil, http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		entries, err := h.trash.List()
+		if err != nil {
+			reqHelper.internalServerError(err)
+			return
+		}
+
+		data := TrashPageData{RestorePath: h.url(trashPath + "restore"), RootPath: h.url("/")}
+		for _, entry := range entries {
+			data.Entries = append(data.Entries, TrashPageEntry{
+				ID:      entry.ID,
+				Path:    entry.Path,
+				Deleted: formatTime(entry.DeletedAt),
+				Reason:  entry.Reason,
+				IsDir:   entry.IsDir,
+				Size:    humanizeSize(entry.Size),
+			})
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := trashTemplate.Execute(w, data); err != nil {
+			reqHelper.log.ErrorContext(reqHelper.ctx, "Error rendering template", "error", err)
+		}
+
+	case action == "restore" && r.Method == http.MethodPost:
+		id := r.PostFormValue("id")
+		entry, restored, err := h.trash.Restore(id)
+		if errors.Is(err, ErrTrashEntryNotFound) {
+			reqHelper.error("NOT FOUND", err, http.StatusNotFound)
+			return
+		} else if err != nil {
+			reqHelper.internalServerError(err)
+			return
+		}
+
+		reqHelper.publishFileOp(FileOpRestore, entry.Path, restored)
+		reqHelper.log.InfoContext(reqHelper.ctx, "RESTORE", "id", id, "path", entry.Path, "target", restored, logger.StatusCodeKey, http.StatusSeeOther)
+
+		if isBrowser(r) {
+			http.Redirect(w, r, h.url(trashPath), http.StatusSeeOther)
+			return
+		}
+		w.Header().Set("Location", h.url(restored))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		reqHelper.error("Method Not Allowed", nil, http.StatusMethodNotAllowed)
+	}
+}
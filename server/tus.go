@@ -0,0 +1,437 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.sakib.dev/le/logger"
+	"go.sakib.dev/le/pkg/nanoid"
+	"go.sakib.dev/le/pkg/utils"
+)
+
+const (
+	// stateDirName is the hidden directory at the root of the served directory
+	// where le keeps its own files. It is never served or listed.
+	stateDirName = ".le"
+
+	// internalPrefix is the URL namespace of le's own endpoints.
+	internalPrefix = "/" + stateDirName + "/"
+
+	tusPath          = internalPrefix + "tus/"
+	tusVersion       = "1.0.0"
+	tusExtensions    = "creation,expiration,termination"
+	tusUploadExpiry  = 24 * time.Hour
+	tusContentType   = "application/offset+octet-stream"
+	tusUploadsDir    = "uploads"
+	tusThreshold     = 8 * 1024 * 1024 // browser uploads above this size use tus
+	tusInfoExtension = ".info"
+	tusPartExtension = ".part"
+)
+
+var ErrUploadNotFound = errors.New("upload not found")
+
+// tusUpload is the on-disk description of a resumable upload. The received
+// bytes live in a ".part" file next to it, its size is the current offset.
+type tusUpload struct {
+	ID        string
+	Length    int64
+	Metadata  string
+	Dir       string
+	FileName  string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// tusStore keeps partial uploads in the state directory of the served file
+// system so finished uploads can be renamed into place.
+type tusStore struct {
+	fsys  WritableFS
+	dir   string
+	locks sync.Map // upload ID -> *sync.Mutex
+}
+
+func newTusStore(fsys WritableFS) *tusStore {
+	return &tusStore{fsys: fsys, dir: path.Join(stateDirName, tusUploadsDir)}
+}
+
+func (s *tusStore) infoName(id string) string {
+	return path.Join(s.dir, id+tusInfoExtension)
+}
+
+func (s *tusStore) partName(id string) string {
+	return path.Join(s.dir, id+tusPartExtension)
+}
+
+func (s *tusStore) create(u *tusUpload) error {
+	if err := mkdirAll(s.fsys, s.dir, 0o755); err != nil {
+		return err
+	}
+
+	f, err := s.fsys.OpenFile(s.partName(u.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	return s.save(u)
+}
+
+func (s *tusStore) save(u *tusUpload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.infoName(u.ID) + ".tmp"
+	f, err := s.fsys.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return s.fsys.Rename(tmp, s.infoName(u.ID))
+}
+
+// get loads an upload and its current offset. Expired uploads are removed and
+// reported as missing.
+func (s *tusStore) get(id string) (*tusUpload, int64, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, 0, ErrUploadNotFound
+	}
+
+	data, err := fs.ReadFile(s.fsys, s.infoName(id))
+	if os.IsNotExist(err) {
+		return nil, 0, ErrUploadNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	var u tusUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, 0, err
+	}
+
+	if time.Now().After(u.ExpiresAt) {
+		s.remove(id)
+		return nil, 0, ErrUploadNotFound
+	}
+
+	info, err := s.fsys.Lstat(s.partName(id))
+	if os.IsNotExist(err) {
+		return nil, 0, ErrUploadNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	return &u, info.Size(), nil
+}
+
+func (s *tusStore) remove(id string) {
+	s.fsys.Remove(s.partName(id))
+	s.fsys.Remove(s.infoName(id))
+	s.locks.Delete(id)
+}
+
+// lock serializes PATCH and DELETE requests for one upload. It reports false
+// when another request is already working on it.
+func (s *tusStore) lock(id string) (unlock func(), ok bool) {
+	mu, _ := s.locks.LoadOrStore(id, &sync.Mutex{})
+	if !mu.(*sync.Mutex).TryLock() {
+		return nil, false
+	}
+	return mu.(*sync.Mutex).Unlock, true
+}
+
+// purgeExpired removes uploads whose expiry time has passed.
+func (s *tusStore) purgeExpired() {
+	entries, err := fs.ReadDir(s.fsys, s.dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), tusInfoExtension); ok {
+			// get removes the upload when it is expired
+			s.get(id)
+		}
+	}
+}
+
+// parseTusMetadata decodes an Upload-Metadata header of comma separated
+// "key base64value" pairs.
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("invalid upload metadata: %q", header)
+		}
+
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upload metadata value for %q: %w", key, err)
+		}
+		meta[key] = string(value)
+	}
+
+	return meta, nil
+}
+
+// serveTus implements the core tus 1.0 protocol together with the creation,
+// expiration and termination extensions.
+func (h handler) serveTus(reqHelper *reqHelper, id string) {
+	w, r := reqHelper.w, reqHelper.r
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		reqHelper.error("Unsupported tus version", nil, http.StatusPreconditionFailed)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		h.tusCreate(reqHelper)
+	case r.Method == http.MethodHead && id != "":
+		h.tusHead(reqHelper, id)
+	case r.Method == http.MethodPatch && id != "":
+		h.tusPatch(reqHelper, id)
+	case r.Method == http.MethodDelete && id != "":
+		h.tusDelete(reqHelper, id)
+	default:
+		reqHelper.error("Method Not Allowed", nil, http.StatusMethodNotAllowed)
+	}
+}
+
+func (h handler) tusCreate(reqHelper *reqHelper) {
+	w, r := reqHelper.w, reqHelper.r
+
+	h.tus.purgeExpired()
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		reqHelper.error("Invalid Upload-Length", err, http.StatusBadRequest)
+		return
+	}
+
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		reqHelper.error("Invalid Upload-Metadata", err, http.StatusBadRequest)
+		return
+	}
+
+	fileName, err := cleanFileName(meta["filename"])
+	if err != nil {
+		reqHelper.error("Invalid file name", err, http.StatusBadRequest)
+		return
+	}
+
+	dir := path.Clean("/" + meta["dir"])
+	dirName, err := h.resolve(dir)
+	if errors.Is(err, utils.ErrForbiddenPath) {
+		reqHelper.error("FORBIDDEN", err, http.StatusForbidden)
+		return
+	} else if err == nil {
+		var info fs.FileInfo
+		if info, err = fs.Stat(h.wfs, dirName); err == nil && !info.IsDir() {
+			err = syscall.ENOTDIR
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		reqHelper.error("Upload directory does not exist", err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		reqHelper.internalServerError(err)
+		return
+	}
+
+	now := time.Now()
+	upload := &tusUpload{
+		ID:        nanoid.NewWithLen(21),
+		Length:    length,
+		Metadata:  r.Header.Get("Upload-Metadata"),
+		Dir:       dir,
+		FileName:  fileName,
+		CreatedAt: now,
+		ExpiresAt: now.Add(tusUploadExpiry),
+	}
+
+	if err := h.tus.create(upload); err != nil {
+		reqHelper.internalServerError(err)
+		return
+	}
+
+	reqHelper.log.InfoContext(reqHelper.ctx, "TUS CREATED", "id", upload.ID, "file", fileName, "dir", dir, "length", length, logger.StatusCodeKey, http.StatusCreated)
+
+	w.Header().Set("Location", h.url(tusPath+upload.ID))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h handler) tusHead(reqHelper *reqHelper, id string) {
+	w := reqHelper.w
+
+	upload, offset, err := h.tus.get(id)
+	if errors.Is(err, ErrUploadNotFound) {
+		reqHelper.error("NOT FOUND", err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		reqHelper.internalServerError(err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h handler) tusPatch(reqHelper *reqHelper, id string) {
+	w, r := reqHelper.w, reqHelper.r
+
+	if r.Header.Get("Content-Type") != tusContentType {
+		reqHelper.error("Unsupported Media Type", nil, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	unlock, ok := h.tus.lock(id)
+	if !ok {
+		reqHelper.error("Upload is locked by another request", nil, http.StatusLocked)
+		return
+	}
+	defer unlock()
+
+	upload, offset, err := h.tus.get(id)
+	if errors.Is(err, ErrUploadNotFound) {
+		reqHelper.error("NOT FOUND", err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		reqHelper.internalServerError(err)
+		return
+	}
+
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || clientOffset != offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		reqHelper.error("Upload-Offset mismatch", err, http.StatusConflict)
+		return
+	}
+
+	if r.ContentLength > upload.Length-offset {
+		reqHelper.error("Chunk exceeds Upload-Length", nil, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	part, err := h.tus.fsys.OpenFile(h.tus.partName(id), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		reqHelper.internalServerError(err)
+		return
+	}
+
+	// bytes that made it to disk are kept even if the client goes away, that is
+	// what makes the upload resumable
+	written, copyErr := receive(reqHelper, part, io.LimitReader(r.Body, upload.Length-offset), upload.FileName, upload.Length)
+	if closeErr := part.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+	offset += written
+
+	upload.ExpiresAt = time.Now().Add(tusUploadExpiry)
+	if err := h.tus.save(upload); err != nil {
+		reqHelper.internalServerError(err)
+		return
+	}
+
+	if copyErr != nil {
+		reqHelper.internalServerError(copyErr)
+		return
+	}
+
+	if offset == upload.Length {
+		name, err := h.finishTusUpload(upload)
+		if err != nil {
+			reqHelper.internalServerError(err)
+			return
+		}
+
+		reqHelper.publishUploadComplete(name, upload.Length)
+		reqHelper.log.InfoContext(reqHelper.ctx, "UPLOAD COMPLETE", "path", path.Join(upload.Dir, name), "size", upload.Length, logger.StatusCodeKey, http.StatusNoContent)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload moves a completed upload into its target directory.
+func (h handler) finishTusUpload(upload *tusUpload) (string, error) {
+	dir, err := h.resolve(upload.Dir)
+	if err != nil {
+		return "", err
+	}
+
+	name, err := h.placeFile(h.tus.partName(upload.ID), dir, upload.FileName)
+	if err != nil {
+		return "", err
+	}
+
+	h.tus.remove(upload.ID)
+
+	return name, nil
+}
+
+func (h handler) tusDelete(reqHelper *reqHelper, id string) {
+	// a PATCH may still be writing to the upload
+	unlock, ok := h.tus.lock(id)
+	if !ok {
+		reqHelper.error("Upload is locked by another request", nil, http.StatusLocked)
+		return
+	}
+	defer unlock()
+
+	if _, _, err := h.tus.get(id); errors.Is(err, ErrUploadNotFound) {
+		reqHelper.error("NOT FOUND", err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		reqHelper.internalServerError(err)
+		return
+	}
+
+	h.tus.remove(id)
+
+	reqHelper.log.InfoContext(reqHelper.ctx, "TUS TERMINATED", "id", id, logger.StatusCodeKey, http.StatusNoContent)
+	reqHelper.w.WriteHeader(http.StatusNoContent)
+}
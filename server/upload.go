@@ -0,0 +1,369 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.sakib.dev/le/logger"
+	"go.sakib.dev/le/pkg/utils"
+)
+
+const uploadFormField = "files"
+
+var ErrInvalidFileName = errors.New("invalid file name")
+
+// handleUpload accepts a multipart/form-data POST and stores every file part of
+// the "files" field in the directory addressed by the request path.
+func (h handler) handleUpload(reqHelper *reqHelper) {
+	r := reqHelper.r
+
+	dir, err := h.resolve(r.URL.Path)
+	if errors.Is(err, utils.ErrForbiddenPath) {
+		reqHelper.error("FORBIDDEN", err, http.StatusForbidden)
+		return
+	} else if err != nil {
+		reqHelper.internalServerError(err)
+		return
+	}
+
+	info, err := fs.Stat(h.wfs, dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			reqHelper.error("NOT FOUND", err, http.StatusNotFound)
+			return
+		}
+		reqHelper.internalServerError(err)
+		return
+	}
+
+	if !info.IsDir() {
+		reqHelper.error("Upload target is not a directory", nil, http.StatusConflict)
+		return
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		reqHelper.error("Bad Request", err, http.StatusBadRequest)
+		return
+	}
+
+	var saved []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			reqHelper.error("Bad Request", err, http.StatusBadRequest)
+			return
+		}
+
+		if part.FormName() != uploadFormField || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		name, err := h.receiveFile(reqHelper, r.URL.Path, part.FileName(), part)
+		part.Close()
+		if errors.Is(err, ErrInvalidFileName) || errors.Is(err, utils.ErrForbiddenPath) {
+			reqHelper.error("Invalid file name", err, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			reqHelper.internalServerError(err)
+			return
+		}
+
+		saved = append(saved, name)
+	}
+
+	if len(saved) == 0 {
+		reqHelper.error("No files in upload", nil, http.StatusBadRequest)
+		return
+	}
+
+	reqHelper.log.InfoContext(reqHelper.ctx, "UPLOAD COMPLETE", "path", r.URL.Path, "files", saved, logger.StatusCodeKey, http.StatusCreated)
+
+	if isBrowser(r) {
+		http.Redirect(reqHelper.w, r, h.url(r.URL.Path), http.StatusSeeOther)
+		return
+	}
+
+	reqHelper.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	reqHelper.w.WriteHeader(http.StatusCreated)
+	for _, name := range saved {
+		fmt.Fprintln(reqHelper.w, path.Join(r.URL.Path, name))
+	}
+}
+
+// receiveFile streams src into a new file named fileName inside the directory
+// at urlDir. The data is written to a temporary file first and renamed into
+// place once complete, so a failed upload never leaves a truncated file behind.
+// If the name is already taken a numeric suffix is added.
+func (h handler) receiveFile(reqHelper *reqHelper, urlDir, fileName string, src io.Reader) (string, error) {
+	name, err := cleanFileName(fileName)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := h.resolve(urlDir)
+	if err != nil {
+		return "", err
+	}
+
+	tmpName, written, err := h.writeTemp(reqHelper, dir, name, src, -1)
+	if err != nil {
+		return "", err
+	}
+	defer h.wfs.Remove(tmpName)
+
+	name, err = h.placeFile(tmpName, dir, name)
+	if err != nil {
+		return "", err
+	}
+
+	reqHelper.publishUploadComplete(name, written)
+
+	return name, nil
+}
+
+// handlePut stores the raw request body at the request path, replacing an
+// existing file. It answers 201 when the file was created and 204 when an
+// existing file was replaced, like a WebDAV server would.
+func (h handler) handlePut(reqHelper *reqHelper) {
+	r := reqHelper.r
+
+	target, err := h.resolve(r.URL.Path)
+	if errors.Is(err, utils.ErrForbiddenPath) {
+		reqHelper.error("FORBIDDEN", err, http.StatusForbidden)
+		return
+	} else if err != nil {
+		reqHelper.internalServerError(err)
+		return
+	}
+
+	name, err := cleanFileName(r.URL.Path)
+	if err != nil || strings.HasSuffix(r.URL.Path, "/") || target == "." {
+		reqHelper.error("PUT needs a file name", err, http.StatusConflict)
+		return
+	}
+
+	var current os.FileInfo
+	if info, err := fs.Stat(h.wfs, target); err == nil {
+		if info.IsDir() {
+			reqHelper.error("Cannot replace a directory", nil, http.StatusConflict)
+			return
+		}
+		current = info
+	} else if !os.IsNotExist(err) {
+		reqHelper.internalServerError(err)
+		return
+	}
+	existed := current != nil
+
+	// If-Match and If-None-Match: * let clients avoid overwriting changes
+	// made by someone else
+	if status := checkPreconditions(r, current); status != http.StatusOK {
+		reqHelper.error("Precondition Failed", nil, status)
+		return
+	}
+
+	dir := path.Dir(target)
+	if info, err := fs.Stat(h.wfs, dir); err != nil || !info.IsDir() {
+		reqHelper.error("Parent directory does not exist", err, http.StatusConflict)
+		return
+	}
+
+	tmpName, written, err := h.writeTemp(reqHelper, dir, name, r.Body, r.ContentLength)
+	if errors.Is(err, ErrContentLengthMismatch) {
+		reqHelper.error("Body does not match Content-Length", err, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		reqHelper.internalServerError(err)
+		return
+	}
+	defer h.wfs.Remove(tmpName)
+
+	var trashed *TrashEntry
+	if existed && h.trash != nil {
+		entry, err := h.trash.Put(h.osPath(target), r.URL.Path, TrashReasonOverwrite)
+		if err != nil {
+			reqHelper.internalServerError(err)
+			return
+		}
+		trashed = &entry
+	}
+
+	if err := h.wfs.Rename(tmpName, target); err != nil {
+		if trashed != nil {
+			h.trash.Restore(trashed.ID)
+		}
+		reqHelper.internalServerError(err)
+		return
+	}
+
+	reqHelper.publishUploadComplete(name, written)
+
+	status := http.StatusCreated
+	if existed {
+		status = http.StatusNoContent
+	} else {
+		reqHelper.w.Header().Set("Location", h.url(r.URL.Path))
+	}
+
+	reqHelper.log.InfoContext(reqHelper.ctx, "UPLOAD COMPLETE", "path", r.URL.Path, "size", written, logger.StatusCodeKey, status)
+	reqHelper.w.WriteHeader(status)
+}
+
+var ErrContentLengthMismatch = errors.New("content length mismatch")
+
+// writeTemp copies src into a new temporary file inside the folder dir of
+// h.wfs and returns its name. When expected is not negative the copy must
+// produce exactly that many bytes. The temporary file is removed on error.
+func (h handler) writeTemp(reqHelper *reqHelper, dir, fileName string, src io.Reader, expected int64) (string, int64, error) {
+	tmp, tmpName, err := h.wfs.CreateTemp(dir, ".le-upload-")
+	if err != nil {
+		return "", 0, err
+	}
+
+	written, err := receive(reqHelper, tmp, src, fileName, expected)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil && expected >= 0 && written != expected {
+		err = fmt.Errorf("%w: got %d bytes, want %d", ErrContentLengthMismatch, written, expected)
+	}
+
+	if err != nil {
+		h.wfs.Remove(tmpName)
+		return "", 0, err
+	}
+
+	return tmpName, written, nil
+}
+
+// receive copies an upload from src to dst. Progress is published and logged
+// the same way downloads are. totalSize is only used for reporting and may be
+// -1 when unknown.
+func receive(reqHelper *reqHelper, dst io.Writer, src io.Reader, fileName string, totalSize int64) (int64, error) {
+	var transferStart = time.Now()
+	var totalReceived int64 = 0
+	var lastReportedReceived int64 = 0
+	var lastReportedTime = time.Now()
+	var err error
+	buf := make([]byte, 1024*1024) // 1MB buffer
+
+	reqHelper.publishUploadStart(fileName, totalSize)
+
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			if _, writeErr := dst.Write(buf[:n]); writeErr != nil {
+				err = writeErr
+				break
+			}
+			totalReceived += int64(n)
+
+			reqHelper.publishUploadProgress(totalReceived)
+
+			if time.Since(lastReportedTime) > downloadProgressLogInterval {
+				mbps := float64(totalReceived-lastReportedReceived) / 1024 / 1024 / time.Since(lastReportedTime).Seconds()
+
+				msg := fmt.Sprintf("%7.2f MB received | %5.2f MB/s", float64(totalReceived)/1024/1024, mbps)
+				reqHelper.log.InfoContext(reqHelper.ctx, msg, "file", fileName)
+
+				lastReportedReceived = totalReceived
+				lastReportedTime = time.Now()
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			err = readErr
+			if errors.Is(readErr, io.ErrUnexpectedEOF) {
+				err = fmt.Errorf("%w: %w", ErrContentLengthMismatch, readErr)
+			}
+			break
+		}
+	}
+
+	if err != nil {
+		reqHelper.log.ErrorContext(reqHelper.ctx, "UPLOAD FAILED", "file", fileName, "received", totalReceived, "error", err)
+		return totalReceived, err
+	}
+
+	reqHelper.log.InfoContext(reqHelper.ctx, "FILE RECEIVED", "file", fileName, "size", totalReceived, "duration", time.Since(transferStart))
+
+	return totalReceived, nil
+}
+
+// placeFile renames the entry src to name inside the folder dir of h.wfs and
+// returns the name it got. If name is taken " (1)", " (2)", ... is added
+// before the extension. The rename claims the name, so concurrent uploads of
+// the same name never replace each other.
+func (h handler) placeFile(src, dir, name string) (string, error) {
+	for i := 0; ; i++ {
+		candidate := numberedName(name, i)
+		target := path.Join(dir, candidate)
+		if isStateDir(target) {
+			return "", utils.ErrForbiddenPath
+		}
+
+		if err := h.wfs.RenameNoReplace(src, target); !errors.Is(err, fs.ErrExist) {
+			return candidate, err
+		}
+	}
+}
+
+// placeFile moves the OS path src into urlDir of the OS directory root like
+// handler.placeFile.
+func placeFile(src, root, urlDir, name string) (string, error) {
+	for i := 0; ; i++ {
+		candidate := numberedName(name, i)
+		target, err := resolvePath(root, path.Join(urlDir, candidate))
+		if err != nil {
+			return "", err
+		}
+
+		if err := utils.MoveFile(src, target); !errors.Is(err, fs.ErrExist) {
+			return candidate, err
+		}
+	}
+}
+
+// numberedName returns name with " (i)" added before the extension, or name
+// itself for 0.
+func numberedName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+}
+
+// cleanFileName strips any directory components a client may have sent along
+// with the file name.
+func cleanFileName(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Base(name)
+
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return "", ErrInvalidFileName
+	}
+
+	return name, nil
+}
+
+func isBrowser(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.sakib.dev/le/pkg/utils"
+	"go.sakib.dev/le/server"
+)
+
+// runShare mints a share link for a file or folder served by le, e.g.
+// `le share --dir ~/Public --max-downloads 1 report.pdf`. The link works as
+// soon as le serves the folder, it needn't be restarted.
+func runShare(args []string) error {
+	flags := flag.NewFlagSet("share", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: le share [flags] <path>\n\n")
+		flags.PrintDefaults()
+	}
+	dir := flags.String("dir", ".", "Directory le serves files from")
+	port := flags.Int("port", 8080, "Port le runs on")
+	expires := flags.Duration("expires", server.DefaultShareTTL, "How long the link works")
+	maxDownloads := flags.Int("max-downloads", 0, "How often the link may be downloaded, 0 for unlimited")
+	password := flags.String("password", "", "Require this password to open the link")
+	useTLS := flags.Bool("tls", false, "le serves HTTPS")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	root, err := utils.ValidAbsDir(*dir)
+	if err != nil {
+		return fmt.Errorf("invalid directory: %w", err)
+	}
+
+	target, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if target, err = filepath.EvalSymlinks(target); err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return errors.New("path is outside of the served directory")
+	}
+
+	share, token, err := server.NewShares(root).Create(filepath.ToSlash(rel), server.ShareOptions{
+		TTL:          *expires,
+		MaxDownloads: *maxDownloads,
+		Password:     *password,
+	})
+	if err != nil {
+		return err
+	}
+
+	localIP, err := utils.GetLocalIP()
+	if err != nil {
+		localIP = "localhost"
+	}
+
+	scheme := "http"
+	if *useTLS {
+		scheme = "https"
+	}
+
+	fmt.Println(server.ShareURL(fmt.Sprintf("%s://%s:%d", scheme, localIP, *port), token))
+	fmt.Fprintf(os.Stderr, "Shares %s until %s\n", share.Path, share.ExpiresAt.Format("Jan 2 15:04"))
+	return nil
+}
@@ -1,34 +1,191 @@
 package tui
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/mdp/qrterminal/v3"
 	"go.sakib.dev/le/server"
 )
 
+type view int
+
+const (
+	viewMain view = iota
+	viewTrash
+	viewShares
+	viewConns
+	viewShutdown
+	viewError
+)
+
+// the fields asked for in turn when creating a share link
+const (
+	shareFieldPath = iota
+	shareFieldExpires
+	shareFieldMaxDownloads
+	shareFieldPassword
+	shareFieldCount
+)
+
+var shareFieldLabels = [shareFieldCount]string{
+	"Path to share",
+	"Expires after",
+	"Max downloads",
+	"Password",
+}
+
+var shareFieldHints = [shareFieldCount]string{
+	"Type a path relative to the served folder",
+	"Type a duration such as 30m or 2h, empty for a day",
+	"Type a number, empty for unlimited",
+	"Type a password, empty for none",
+}
+
 type model struct {
-	srvr *server.Server
+	srvr    *server.Server
+	view    view
+	trash   []server.TrashEntry
+	shares  []server.Share
+	cursor  int
+	message string
+	waiting bool // chose to wait for active transfers while shutting down
+
+	err       error  // why the server isn't running
+	portInput string // port to retry on after err
+
+	sharing    bool                    // filling in a new share link
+	shareField int                     // field being typed
+	shareInput [shareFieldCount]string // fields of the new share link
 }
 
-func newModel(srvr *server.Server) model {
-	return model{
+// shutdownDoneMsg is sent once the server has stopped and all transfers have
+// finished.
+type shutdownDoneMsg struct {
+	err error
+}
+
+func shutdown(srvr *server.Server) tea.Cmd {
+	return func() tea.Msg {
+		return shutdownDoneMsg{err: srvr.Shutdown(context.Background())}
+	}
+}
+
+func newModel(srvr *server.Server, listenErr error) model {
+	m := model{
 		srvr: srvr,
 	}
+	if listenErr != nil {
+		m.view = viewError
+		m.err = listenErr
+	}
+	return m
+}
+
+// listenDoneMsg carries the result of binding the port again.
+type listenDoneMsg struct {
+	err error
+}
+
+// serveDoneMsg is sent when the server stopped serving, err is nil after a
+// shutdown.
+type serveDoneMsg struct {
+	err error
+}
+
+func listen(srvr *server.Server) tea.Cmd {
+	return func() tea.Msg {
+		return listenDoneMsg{err: srvr.Listen()}
+	}
+}
+
+func serve(srvr *server.Server) tea.Cmd {
+	return func() tea.Msg {
+		return serveDoneMsg{err: srvr.Serve()}
+	}
 }
 
 func (m model) Init() tea.Cmd {
-	return nil
+	if m.err != nil {
+		return nil
+	}
+	return serve(m.srvr)
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
+	case shutdownDoneMsg:
+		return m, tea.Quit
+	case listenDoneMsg:
+		if msg.err != nil {
+			m.err = msg.err
+			return m, nil
+		}
+		m.view, m.err, m.portInput = viewMain, nil, ""
+		return m, serve(m.srvr)
+	case serveDoneMsg:
+		if msg.err != nil {
+			m.view, m.err = viewError, msg.err
+		}
+		return m, nil
 	case tea.KeyMsg:
+		switch m.view {
+		case viewShutdown:
+			return m.updateShutdown(msg)
+		case viewError:
+			return m.updateError(msg)
+		}
+
+		if m.sharing && msg.String() != "ctrl+c" {
+			// typed keys belong to the path, even 'q'
+			return m.updateShareInput(msg)
+		}
+
 		if msg.String() == "ctrl+c" || msg.String() == "q" {
-			return m, tea.Quit
+			// new connections are refused from here on, active transfers
+			// drain until the user decides not to wait for them
+			m.view = viewShutdown
+			return m, shutdown(m.srvr)
+		}
+
+		if m.view == viewTrash {
+			return m.updateTrash(msg)
+		}
+		if m.view == viewShares {
+			return m.updateShares(msg)
+		}
+		if m.view == viewConns {
+			return m.updateConns(msg)
+		}
+
+		if msg.String() == "t" && m.srvr.GetState().Upload {
+			m.view = viewTrash
+			m.cursor = 0
+			m.message = ""
+			m.loadTrash()
+		}
+
+		if msg.String() == "c" {
+			m.view = viewConns
+			m.cursor = 0
+			m.message = ""
+		}
+
+		if msg.String() == "s" {
+			m.view = viewShares
+			m.cursor = 0
+			m.message = ""
+			m.loadShares()
+		}
+
+		if key := msg.String(); key == "a" || key == "d" {
+			m.decide(key == "a")
 		}
 	case string:
 		if msg == "update" {
@@ -42,7 +199,485 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+func (m model) updateTrash(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "t":
+		m.view = viewMain
+		m.message = ""
+	case "up", "k":
+		if m.cursor > 0 {
+			m.cursor--
+		}
+	case "down", "j":
+		if m.cursor < len(m.trash)-1 {
+			m.cursor++
+		}
+	case "r", "enter":
+		if m.cursor < len(m.trash) {
+			entry := m.trash[m.cursor]
+			if err := m.srvr.RestoreTrash(entry.ID); err != nil {
+				m.message = fmt.Sprintf("Failed to restore %s: %v", entry.Path, err)
+			} else {
+				m.message = fmt.Sprintf("Restored %s", entry.Path)
+			}
+			m.loadTrash()
+		}
+	}
+
+	return m, nil
+}
+
+func (m model) updateShares(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "s":
+		m.view = viewMain
+		m.message = ""
+	case "up", "k":
+		if m.cursor > 0 {
+			m.cursor--
+		}
+	case "down", "j":
+		if m.cursor < len(m.shares)-1 {
+			m.cursor++
+		}
+	case "n":
+		m.sharing = true
+		m.shareField = shareFieldPath
+		m.shareInput = [shareFieldCount]string{}
+		m.message = ""
+	case "x":
+		if m.cursor < len(m.shares) {
+			share := m.shares[m.cursor]
+			if err := m.srvr.RevokeShare(share.ID); err != nil {
+				m.message = fmt.Sprintf("Failed to revoke the link to %s: %v", share.Path, err)
+			} else {
+				m.message = fmt.Sprintf("Revoked the link to %s", share.Path)
+			}
+			m.loadShares()
+		}
+	}
+
+	return m, nil
+}
+
+func (m model) updateShareInput(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	input := &m.shareInput[m.shareField]
+
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.sharing = false
+		m.message = ""
+	case tea.KeyBackspace:
+		if *input != "" {
+			runes := []rune(*input)
+			*input = string(runes[:len(runes)-1])
+		}
+	case tea.KeyEnter:
+		if m.shareField == shareFieldPath && *input == "" {
+			m.sharing = false
+			return m, nil
+		}
+
+		opts, err := m.shareOptions()
+		if err != nil {
+			m.message = fmt.Sprintf("Invalid input: %v", err)
+			return m, nil
+		}
+		m.message = ""
+
+		if m.shareField < shareFieldPassword {
+			m.shareField++
+			return m, nil
+		}
+
+		m.sharing = false
+		urlPath := m.shareInput[shareFieldPath]
+		share, link, err := m.srvr.CreateShare(urlPath, opts)
+		if err != nil {
+			m.message = fmt.Sprintf("Failed to share %s: %v", urlPath, err)
+		} else {
+			m.message = fmt.Sprintf("Shared %s until %s:\n  %s", urlPath, share.ExpiresAt.Format("Jan 2 15:04"), link)
+		}
+		m.cursor = 0
+		m.loadShares()
+	case tea.KeyRunes, tea.KeySpace:
+		*input += string(msg.Runes)
+	}
+
+	return m, nil
+}
+
+// shareOptions parses the options typed so far for a new share link.
+func (m model) shareOptions() (server.ShareOptions, error) {
+	var opts server.ShareOptions
+
+	if expires := strings.TrimSpace(m.shareInput[shareFieldExpires]); expires != "" {
+		ttl, err := time.ParseDuration(expires)
+		if err != nil || ttl <= 0 {
+			return opts, fmt.Errorf("%q is not a duration", expires)
+		}
+		opts.TTL = ttl
+	}
+
+	if maxDownloads := strings.TrimSpace(m.shareInput[shareFieldMaxDownloads]); maxDownloads != "" {
+		n, err := strconv.Atoi(maxDownloads)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("%q is not a number of downloads", maxDownloads)
+		}
+		opts.MaxDownloads = n
+	}
+
+	opts.Password = m.shareInput[shareFieldPassword]
+	return opts, nil
+}
+
+func (m model) updateConns(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	clients := m.clients()
+
+	switch msg.String() {
+	case "esc", "c":
+		m.view = viewMain
+		m.message = ""
+	case "up", "k":
+		if m.cursor > 0 {
+			m.cursor--
+		}
+	case "down", "j":
+		if m.cursor < len(clients)-1 {
+			m.cursor++
+		}
+	case "b", "u":
+		// 'b' bans a connected client, 'u' lifts a ban
+		if m.cursor >= len(clients) || clients[m.cursor].banned != (msg.String() == "u") {
+			return m, nil
+		}
+		client := clients[m.cursor]
+
+		ban, verb := m.srvr.Ban, "Banned"
+		if client.banned {
+			ban, verb = m.srvr.Unban, "Unbanned"
+		}
+		if err := ban(client.ip); err != nil {
+			m.message = fmt.Sprintf("Failed to change the ban of %s: %v", client.ip, err)
+		} else {
+			m.message = fmt.Sprintf("%s %s", verb, client.ip)
+		}
+	}
+
+	return m, nil
+}
+
+// connClient is a line of the connection list, a client with its open
+// connections or a banned IP.
+type connClient struct {
+	ip     string
+	device string
+	files  []string
+	banned bool
+}
+
+// clients returns the connected clients by IP, followed by the banned ones.
+func (m model) clients() []connClient {
+	state := m.srvr.GetState()
+
+	byIP := make(map[string]*connClient)
+	for _, conn := range state.Conns {
+		if conn.Client == nil {
+			continue
+		}
+		client, ok := byIP[conn.Client.IP]
+		if !ok {
+			client = &connClient{ip: conn.Client.IP, device: conn.Client.Device}
+			byIP[conn.Client.IP] = client
+		}
+		client.files = append(client.files, conn.Filename)
+	}
+
+	clients := make([]connClient, 0, len(byIP))
+	for _, client := range byIP {
+		slices.Sort(client.files)
+		clients = append(clients, *client)
+	}
+	slices.SortFunc(clients, func(a, b connClient) int {
+		return strings.Compare(a.ip, b.ip)
+	})
+
+	for _, ip := range m.srvr.Banned() {
+		clients = append(clients, connClient{ip: ip, banned: true})
+	}
+	return clients
+}
+
+func (m model) connsView() string {
+	clients := m.clients()
+
+	str := "Connections\n\n"
+
+	if len(clients) == 0 {
+		str += "  Nobody is connected\n"
+	}
+
+	for i, client := range clients {
+		cursor := "  "
+		if i == m.cursor {
+			cursor = "> "
+		}
+		if client.banned {
+			str += fmt.Sprintf("%s%-39s banned\n", cursor, client.ip)
+			continue
+		}
+		str += fmt.Sprintf("%s%-39s %-10s %s\n", cursor, client.ip, client.device, strings.Join(client.files, ", "))
+	}
+
+	if m.message != "" {
+		str += "\n" + m.message + "\n"
+	}
+
+	str += "\nUp/Down to select, 'b' to ban, 'u' to unban, Esc to go back, 'q' to quit.\n"
+
+	return str
+}
+
+func (m model) updateShutdown(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "w", "enter":
+		m.waiting = true
+	case "f", "ctrl+c":
+		m.srvr.Close()
+		return m, tea.Quit
+	}
+
+	return m, nil
+}
+
+func (m model) updateError(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch key := msg.String(); key {
+	case "ctrl+c", "q":
+		// nothing is being served, so there is nothing to shut down
+		return m, tea.Quit
+	case "backspace":
+		if m.portInput != "" {
+			m.portInput = m.portInput[:len(m.portInput)-1]
+		}
+	case "enter":
+		// an empty port lets the system pick a free one
+		port, err := strconv.Atoi(m.portInput)
+		if m.portInput != "" && (err != nil || port > 65535) {
+			m.err = fmt.Errorf("invalid port %q", m.portInput)
+			return m, nil
+		}
+		m.srvr.Port = port
+		return m, listen(m.srvr)
+	default:
+		if len(key) == 1 && key[0] >= '0' && key[0] <= '9' && len(m.portInput) < 5 {
+			m.portInput += key
+		}
+	}
+
+	return m, nil
+}
+
+// decide approves or denies the client that has been waiting the longest.
+func (m *model) decide(approve bool) {
+	pending := m.srvr.PendingClients()
+	if len(pending) == 0 {
+		return
+	}
+
+	decide := m.srvr.Deny
+	if approve {
+		decide = m.srvr.Approve
+	}
+	if err := decide(pending[0].IP); err != nil {
+		m.message = fmt.Sprintf("Failed to decide on %s: %v", pending[0].IP, err)
+	} else {
+		m.message = ""
+	}
+}
+
+func approvalPrompt(pending []server.Client) string {
+	client := pending[0]
+
+	str := "New device wants to connect:\n"
+	str += fmt.Sprintf("  %s  %s", client.Device, client.IP)
+	if client.Host != "" && client.Host != client.IP {
+		str += fmt.Sprintf("  (%s)", client.Host)
+	}
+	str += "\nPress 'a' to allow or 'd' to deny."
+	if len(pending) > 1 {
+		str += fmt.Sprintf(" %d more waiting.", len(pending)-1)
+	}
+	return str + "\n\n"
+}
+
+func (m *model) loadTrash() {
+	entries, err := m.srvr.TrashEntries()
+	if err != nil {
+		m.message = fmt.Sprintf("Failed to read trash: %v", err)
+	}
+	m.trash = entries
+	if m.cursor >= len(m.trash) {
+		m.cursor = max(len(m.trash)-1, 0)
+	}
+}
+
+func (m model) trashView() string {
+	str := "Trash\n\n"
+
+	if len(m.trash) == 0 {
+		str += "  The trash is empty\n"
+	}
+
+	for i, entry := range m.trash {
+		cursor := "  "
+		if i == m.cursor {
+			cursor = "> "
+		}
+		str += fmt.Sprintf("%s%s  %-9s %s\n", cursor, entry.DeletedAt.Format("Jan 2 15:04"), entry.Reason, entry.Path)
+	}
+
+	if m.message != "" {
+		str += "\n" + m.message + "\n"
+	}
+
+	str += "\nUp/Down to select, 'r' to restore, Esc to go back, 'q' to quit.\n"
+
+	return str
+}
+
+func (m *model) loadShares() {
+	shares, err := m.srvr.Shares()
+	if err != nil {
+		m.message = fmt.Sprintf("Failed to read share links: %v", err)
+	}
+	m.shares = slices.DeleteFunc(shares, func(share server.Share) bool {
+		return !share.Active()
+	})
+	if m.cursor >= len(m.shares) {
+		m.cursor = max(len(m.shares)-1, 0)
+	}
+}
+
+func (m model) sharesView() string {
+	str := "Share links\n\n"
+
+	if len(m.shares) == 0 {
+		str += "  No active links\n"
+	}
+
+	for i, share := range m.shares {
+		cursor := "  "
+		if i == m.cursor {
+			cursor = "> "
+		}
+		downloads := strconv.Itoa(share.Downloads)
+		if share.MaxDownloads > 0 {
+			downloads += "/" + strconv.Itoa(share.MaxDownloads)
+		}
+		password := ""
+		if share.HasPassword() {
+			password = "  password"
+		}
+		str += fmt.Sprintf("%s%-30s %6s downloads  expires %s%s\n", cursor, share.Path, downloads, share.ExpiresAt.Format("Jan 2 15:04"), password)
+	}
+
+	if m.sharing {
+		str += "\n"
+		for field := shareFieldPath; field <= m.shareField; field++ {
+			input := m.shareInput[field]
+			if field == shareFieldPassword {
+				input = strings.Repeat("*", len([]rune(input)))
+			}
+			if field == m.shareField {
+				input += "_"
+			}
+			str += fmt.Sprintf("%s: %s\n", shareFieldLabels[field], input)
+		}
+		if m.message != "" {
+			str += "\n" + m.message + "\n"
+		}
+		str += "\n" + shareFieldHints[m.shareField] + " and press Enter, Esc to cancel.\n"
+		return str
+	}
+
+	if m.message != "" {
+		str += "\n" + m.message + "\n"
+	}
+
+	str += "\nUp/Down to select, 'n' for a new link, 'x' to revoke, Esc to go back, 'q' to quit.\n"
+
+	return str
+}
+
+func (m model) shutdownView() string {
+	state := m.srvr.GetState()
+
+	str := "Shutting down, new connections are refused.\n\n"
+
+	if len(state.Conns) == 0 {
+		return str + "Waiting for the server to stop...\n"
+	}
+
+	conns := make([]*server.Conn, 0, len(state.Conns))
+	for _, conn := range state.Conns {
+		conns = append(conns, conn)
+	}
+	slices.SortFunc(conns, func(a, b *server.Conn) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	str += fmt.Sprintf("%d active transfers:\n", len(conns))
+	for _, conn := range conns {
+		client := "unknown"
+		if conn.Client != nil {
+			client = conn.Client.Host
+		}
+		str += fmt.Sprintf("  %-30s %10s sent %10s received  %s\n", conn.Filename, formatBytes(conn.TotalSent), formatBytes(conn.TotalReceived), client)
+	}
+
+	if m.waiting {
+		str += fmt.Sprintf("\nWaiting for %d active transfers to finish. Press 'f' or Ctrl+C to force quit.\n", len(conns))
+	} else {
+		str += fmt.Sprintf("\nPress 'w' to wait for %d active transfers or 'f' to force quit.\n", len(conns))
+	}
+
+	return str
+}
+
+func (m model) errorView() string {
+	str := fmt.Sprintf("Could not start the server:\n  %v\n\n", m.err)
+	str += fmt.Sprintf("Retry on port: %s_\n\n", m.portInput)
+	str += "Type a port and press Enter to retry, leave it empty to use any free port.\nPress Ctrl+C or 'q' to quit.\n"
+	return str
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 func (m model) View() string {
+	switch m.view {
+	case viewTrash:
+		return m.trashView()
+	case viewShares:
+		return m.sharesView()
+	case viewConns:
+		return m.connsView()
+	case viewShutdown:
+		return m.shutdownView()
+	case viewError:
+		return m.errorView()
+	}
+
 	state := m.srvr.GetState()
 	if state.Addr == nil {
 		// return a loading indicator
@@ -58,20 +693,48 @@ func (m model) View() string {
 		BlackChar:  qrterminal.BLACK_BLACK,
 	})
 
+	str := ""
+	if pending := m.srvr.PendingClients(); len(pending) > 0 {
+		str += approvalPrompt(pending)
+	}
+	if m.message != "" {
+		str += m.message + "\n\n"
+	}
+
 	connCount := len(state.Conns)
-	str := fmt.Sprintf("Server running at: %s\nNumber of connections: %d\n", *state.Addr, connCount)
+	str += fmt.Sprintf("Server running at: %s\nNumber of connections: %d\n", *state.Addr, connCount)
 
+	if state.Fingerprint != "" {
+		str += fmt.Sprintf("Certificate SHA-256: %s\n", state.Fingerprint)
+	}
 	str += fmt.Sprintf("From directory %s\n", state.Dir)
+	if state.Upload {
+		str += "Uploads are enabled\n"
+	}
 
 	str += stringWriter.String()
 
+	if len(state.Activity) > 0 {
+		str += "\nRecent activity:\n"
+		for _, a := range state.Activity {
+			str += fmt.Sprintf("  %s  %s %s\n", a.Time.Format("15:04:05"), a.Client, a.Message)
+		}
+	}
+
+	if state.Upload {
+		str += "\nPress 't' to open the trash."
+	}
+	str += "\nPress 'c' to list connections, 's' to manage share links."
 	str += "\nPress Ctrl+C or 'q' to quit.\n\n"
 
 	return str
 }
 
-func Start(srvr *server.Server, ch <-chan server.ServerEventName) error {
-	p := tea.NewProgram(newModel(srvr), tea.WithAltScreen())
+// Start runs the UI and serves files with srvr until the user quits. srvr must
+// have called Listen, listenErr is the error it returned. If the server never
+// ran, the last error is returned once the UI is closed.
+func Start(srvr *server.Server, ch <-chan server.ServerEventName, listenErr error) error {
+	p := tea.NewProgram(newModel(srvr, listenErr), tea.WithAltScreen())
 
 	go func() {
 		for range ch {
@@ -81,15 +744,19 @@ func Start(srvr *server.Server, ch <-chan server.ServerEventName) error {
 
 	// Save original stdout
 	old := os.Stdout
+	defer func() { os.Stdout = old }() // Restore original stdout
 
 	// Redirect stdout to /dev/null
 	devNull, _ := os.Open(os.DevNull)
 	os.Stdout = devNull
 
-	if _, err := p.Run(); err != nil {
+	final, err := p.Run()
+	if err != nil {
 		return err
 	}
 
-	os.Stdout = old // Restore original stdout
+	if m, ok := final.(model); ok && m.view == viewError {
+		return m.err
+	}
 	return nil
 }